@@ -0,0 +1,242 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+	"google.golang.org/api/cloudidentity/v1"
+	"google.golang.org/api/googleapi"
+)
+
+// the Cloud Identity labels of security and dynamic groups
+const (
+	securityLabel = "cloudidentity.googleapis.com/groups.security"
+	dynamicLabel  = "cloudidentity.googleapis.com/groups.dynamic"
+)
+
+var (
+	cloudIdentityService *cloudidentity.Service
+
+	// the resource name (groups/<id>) of every group listed, by email
+	ciGroupNames = make(map[string]string)
+	ciNamesMutex = &sync.Mutex{}
+	// set once searching transitive memberships failed (it needs Cloud Identity Premium)
+	noTransitive int32
+)
+
+// getCloudIdentityGroups is getGroups with the Cloud Identity Groups API
+// (--groupsAPI=cloudidentity): besides the members, it records each group's labels
+// (security, dynamic, POSIX...), the queries of dynamic groups and, with
+// --transitiveMembers, the members of nested groups the crawl can't expand.
+func getCloudIdentityGroups(ctx context.Context) {
+	defer wg.Done()
+	glog.V(2).Infoln(">>>>>>>>>>> Getting Cloud Identity Groups")
+
+	var previous []string
+	for _, g := range orgGraph.verticesWithLabel("group") {
+		if name := stringProperty(g, "cloudIdentityName"); name != "" {
+			email := fmt.Sprint(g.Key[0].Value)
+			setCloudIdentityName(email, name)
+			previous = append(previous, email)
+		}
+	}
+
+	listGroups(ctx, "cigroups", previous, func(pageToken string) ([]string, string, error) {
+		q := cloudIdentityService.Groups.List().Parent("customers/" + *cx).View("FULL")
+		if pageToken != "" {
+			q = q.PageToken(pageToken)
+		}
+		r, err := q.Context(ctx).Do()
+		if err != nil {
+			return nil, "", err
+		}
+		var groups []string
+		for _, g := range r.Groups {
+			if g.GroupKey == nil {
+				continue
+			}
+			glog.V(4).Infoln("            Adding Group: ", g.GroupKey.Id)
+			upsertVertex(cloudIdentityGroupVertex(g))
+			setCloudIdentityName(g.GroupKey.Id, g.Name)
+			groups = append(groups, g.GroupKey.Id)
+		}
+		return groups, r.NextPageToken, nil
+	}, getCloudIdentityMembers)
+}
+
+func setCloudIdentityName(email, name string) {
+	ciNamesMutex.Lock()
+	defer ciNamesMutex.Unlock()
+	ciGroupNames[email] = name
+}
+
+func cloudIdentityName(email string) string {
+	ciNamesMutex.Lock()
+	defer ciNamesMutex.Unlock()
+	return ciGroupNames[email]
+}
+
+// cloudIdentityGroupVertex is a group with its Cloud Identity resource name, labels
+// (isSecurityGroup and isDynamic are set for the security and dynamic labels) and,
+// for a dynamic group, its membership queries, eg.
+// USER: user.organizations.exists(org, org.department=='eng')
+func cloudIdentityGroupVertex(g *cloudidentity.Group) *Vertex {
+	labels := make([]string, 0, len(g.Labels))
+	for l := range g.Labels {
+		labels = append(labels, l)
+	}
+	sort.Strings(labels)
+	_, security := g.Labels[securityLabel]
+	_, dynamic := g.Labels[dynamicLabel]
+	v := groupVertex(g.GroupKey.Id).
+		set("isExternal", false).
+		set("cloudIdentityName", g.Name).
+		set("displayName", g.DisplayName).
+		set("isSecurityGroup", security).
+		set("isDynamic", dynamic || g.DynamicGroupMetadata != nil)
+	if len(labels) > 0 {
+		v.set("labels", labels)
+	}
+	if d := g.DynamicGroupMetadata; d != nil {
+		var queries []string
+		for _, q := range d.Queries {
+			queries = append(queries, q.ResourceType+": "+q.Query)
+		}
+		if len(queries) > 0 {
+			v.set("dynamicQueries", queries)
+		}
+		if d.Status != nil {
+			v.set("dynamicStatus", d.Status.Status)
+		}
+	}
+	return v
+}
+
+// getCloudIdentityMembers adds the members of one group to the graph and returns the
+// groups nested in it.
+func getCloudIdentityMembers(ctx context.Context, email string) []string {
+	glog.V(2).Infoln(">>>>>>>>>>> Getting Cloud Identity Memberships for Group ", email)
+	unit := "cigroup:" + email
+	if nested, ok := state.isDone(unit); ok {
+		return nested
+	}
+	name := cloudIdentityName(email)
+	if name == "" {
+		// a nested group that isn't the customer's
+		glog.Infof("Group %s cannot be expanded for members;  Possibly a group outside of the Gsuites domain", email)
+		state.markDone(unit)
+		return nil
+	}
+
+	var nested []string
+	err := cloudIdentityService.Groups.Memberships.List(name).View("FULL").Pages(ctx, func(r *cloudidentity.ListMembershipsResponse) error {
+		for _, m := range r.Memberships {
+			if m.PreferredMemberKey == nil {
+				continue
+			}
+			id := m.PreferredMemberKey.Id
+			glog.V(4).Infof("            Adding Member to Group %v : %v", email, id)
+			var member *Vertex
+			switch m.Type {
+			case "USER":
+				member = userVertex(id)
+			case "SERVICE_ACCOUNT":
+				member = serviceAccountVertex(id)
+			case "GROUP":
+				member = groupVertex(id)
+				nested = append(nested, id)
+			default:
+				glog.V(4).Infof("            Skipping %v member %v of Group %v", m.Type, id, email)
+				continue
+			}
+			upsertEdge(inEdge(member, groupVertex(email)).set("role", cloudIdentityRole(m.Roles)))
+		}
+		return nil
+	})
+	if err != nil {
+		addError("groups", email, err)
+		return nested
+	}
+	if *transitiveMembers {
+		getTransitiveMembers(ctx, email, name)
+	}
+	state.markDone(unit, nested...)
+	return nested
+}
+
+// cloudIdentityRole is the highest of a membership's roles: OWNER, MANAGER or MEMBER.
+func cloudIdentityRole(roles []*cloudidentity.MembershipRole) string {
+	role := "MEMBER"
+	for _, r := range roles {
+		switch {
+		case r.Name == "OWNER":
+			return r.Name
+		case r.Name == "MANAGER":
+			role = r.Name
+		}
+	}
+	return role
+}
+
+// getTransitiveMembers adds member -transitiveIn-> group edges for the members of the
+// group through nested groups, including the groups outside the customer the crawl
+// can't expand.  It needs Cloud Identity Premium: the first failure turns it off.
+func getTransitiveMembers(ctx context.Context, email, name string) {
+	if atomic.LoadInt32(&noTransitive) == 1 {
+		return
+	}
+	err := cloudIdentityService.Groups.Memberships.SearchTransitiveMemberships(name).Pages(ctx, func(r *cloudidentity.SearchTransitiveMembershipsResponse) error {
+		for _, m := range r.Memberships {
+			if m.RelationType == "DIRECT" || len(m.PreferredMemberKey) == 0 {
+				continue
+			}
+			id := m.PreferredMemberKey[0].Id
+			var member *Vertex
+			switch {
+			case strings.HasPrefix(m.Member, "groups/"):
+				member = groupVertex(id)
+			case strings.HasSuffix(id, ".gserviceaccount.com"):
+				member = serviceAccountVertex(id)
+			default:
+				member = userVertex(id)
+			}
+			role := "MEMBER"
+			for _, r := range m.Roles {
+				if r.Role == "OWNER" || (r.Role == "MANAGER" && role != "OWNER") {
+					role = r.Role
+				}
+			}
+			upsertEdge((&Edge{Label: "transitiveIn", From: member, To: groupVertex(email)}).
+				set("relationType", m.RelationType).set("role", role))
+		}
+		return nil
+	})
+	if err != nil {
+		if gerr, ok := err.(*googleapi.Error); ok && (gerr.Code == 403 || gerr.Code == 400) {
+			if atomic.CompareAndSwapInt32(&noTransitive, 0, 1) {
+				glog.Warningf("Transitive memberships are not available (%v), only direct memberships are loaded", err)
+			}
+			return
+		}
+		addError("groups", email+" transitive memberships", err)
+	}
+}
@@ -0,0 +1,211 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"reflect"
+	"sort"
+
+	"github.com/golang/glog"
+)
+
+// vertexChange is a vertex that differs between two graphs: old is nil if the vertex
+// was added, v is nil if it was removed, otherwise its properties changed.
+type vertexChange struct {
+	old *Vertex
+	v   *Vertex
+}
+
+type edgeChange struct {
+	old *Edge
+	e   *Edge
+}
+
+// graphDiff is what changed between two crawls, ordered by id.
+type graphDiff struct {
+	vertices []vertexChange
+	edges    []edgeChange
+}
+
+// diffGraphs compares the graph of the previous run with the current one.
+func diffGraphs(old, cur *graph) *graphDiff {
+	d := &graphDiff{}
+
+	ov, cv := old.sortedVertices(), cur.sortedVertices()
+	for i, j := 0, 0; i < len(ov) || j < len(cv); {
+		switch {
+		case j == len(cv) || (i < len(ov) && ov[i].ID() < cv[j].ID()):
+			d.vertices = append(d.vertices, vertexChange{old: ov[i]})
+			i++
+		case i == len(ov) || cv[j].ID() < ov[i].ID():
+			d.vertices = append(d.vertices, vertexChange{v: cv[j]})
+			j++
+		default:
+			if !sameProperties(ov[i].Properties, cv[j].Properties) {
+				d.vertices = append(d.vertices, vertexChange{old: ov[i], v: cv[j]})
+			}
+			i++
+			j++
+		}
+	}
+
+	oe, ce := old.sortedEdges(), cur.sortedEdges()
+	for i, j := 0, 0; i < len(oe) || j < len(ce); {
+		switch {
+		case j == len(ce) || (i < len(oe) && oe[i].ID() < ce[j].ID()):
+			d.edges = append(d.edges, edgeChange{old: oe[i]})
+			i++
+		case i == len(oe) || ce[j].ID() < oe[i].ID():
+			d.edges = append(d.edges, edgeChange{e: ce[j]})
+			j++
+		default:
+			if !sameProperties(oe[i].Properties, ce[j].Properties) {
+				d.edges = append(d.edges, edgeChange{old: oe[i], e: ce[j]})
+			}
+			i++
+			j++
+		}
+	}
+	return d
+}
+
+// sameProperties compares the properties regardless of their order (or the order of
+// the values of multi-valued properties, which depends on the order things were crawled).
+func sameProperties(a, b []Property) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for _, p := range a {
+		i := findProperty(b, p.Key)
+		if i < 0 {
+			return false
+		}
+		al, aList := p.Value.([]string)
+		bl, bList := b[i].Value.([]string)
+		if aList && bList {
+			al = append([]string{}, al...)
+			bl = append([]string{}, bl...)
+			sort.Strings(al)
+			sort.Strings(bl)
+			if !reflect.DeepEqual(al, bl) {
+				return false
+			}
+			continue
+		}
+		if !reflect.DeepEqual(p.Value, b[i].Value) {
+			return false
+		}
+	}
+	return true
+}
+
+// counts returns the number of vertices and edges added, changed and removed.
+func (d *graphDiff) counts() (added, changed, removed int) {
+	count := func(old, cur bool) {
+		switch {
+		case !old:
+			added++
+		case !cur:
+			removed++
+		default:
+			changed++
+		}
+	}
+	for _, c := range d.vertices {
+		count(c.old != nil, c.v != nil)
+	}
+	for _, c := range d.edges {
+		count(c.old != nil, c.e != nil)
+	}
+	return added, changed, removed
+}
+
+// keepRemoved drops the removals from the diff and puts the removed vertices and edges
+// back into cur: when part of the crawl failed, something missing from cur may
+// still exist, so it is kept in the graph database (and the next snapshot).
+func (d *graphDiff) keepRemoved(cur *graph) {
+	vertices := d.vertices[:0]
+	for _, c := range d.vertices {
+		if c.v == nil {
+			cur.upsertVertex(c.old)
+			continue
+		}
+		vertices = append(vertices, c)
+	}
+	d.vertices = vertices
+	edges := d.edges[:0]
+	for _, c := range d.edges {
+		if c.e == nil {
+			cur.upsertEdge(c.old)
+			continue
+		}
+		edges = append(edges, c)
+	}
+	d.edges = edges
+}
+
+// writeChanges applies the diff to the sinks that implement ChangeSink: edges are
+// removed first, then vertices; vertices are added or updated before edges.  The other
+// sinks (eg, graphml, which rewrites its file anyway) get the whole graph.
+func writeChanges(s Sink, d *graphDiff, g *graph) error {
+	if m, ok := s.(multiSink); ok {
+		return m.each(func(s Sink) error { return writeChanges(s, d, g) })
+	}
+	cs, ok := s.(ChangeSink)
+	if !ok {
+		glog.V(2).Infof(">>>>>>>>>>> %T can't apply changes, writing the whole graph", s)
+		return s.WriteGraph(g)
+	}
+
+	var first error
+	check := func(err error) {
+		if err != nil {
+			glog.Error(err)
+			if first == nil {
+				first = err
+			}
+		}
+	}
+	for _, c := range d.edges {
+		if c.e == nil {
+			check(cs.DropEdge(c.old))
+		}
+	}
+	for _, c := range d.vertices {
+		if c.v == nil {
+			check(cs.DropVertex(c.old))
+		}
+	}
+	for _, c := range d.vertices {
+		switch {
+		case c.v == nil:
+		case c.old == nil:
+			check(cs.UpsertVertex(c.v))
+		default:
+			check(cs.UpdateVertex(c.old, c.v))
+		}
+	}
+	for _, c := range d.edges {
+		switch {
+		case c.e == nil:
+		case c.old == nil:
+			check(cs.UpsertEdge(c.e))
+		default:
+			check(cs.UpdateEdge(c.old, c.e))
+		}
+	}
+	check(cs.Flush())
+	return first
+}
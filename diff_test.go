@@ -0,0 +1,203 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// fakeChangeSink records the calls it gets as "Op id".
+type fakeChangeSink struct {
+	calls []string
+}
+
+func (s *fakeChangeSink) record(op, id string) error {
+	s.calls = append(s.calls, op+" "+id)
+	return nil
+}
+
+func (s *fakeChangeSink) WriteGraph(g *graph) error         { return s.record("WriteGraph", "") }
+func (s *fakeChangeSink) Close() error                      { return s.record("Close", "") }
+func (s *fakeChangeSink) Flush() error                      { return s.record("Flush", "") }
+func (s *fakeChangeSink) UpsertVertex(v *Vertex) error      { return s.record("UpsertVertex", v.ID()) }
+func (s *fakeChangeSink) UpsertEdge(e *Edge) error          { return s.record("UpsertEdge", e.ID()) }
+func (s *fakeChangeSink) UpdateVertex(old, v *Vertex) error { return s.record("UpdateVertex", v.ID()) }
+func (s *fakeChangeSink) UpdateEdge(old, e *Edge) error     { return s.record("UpdateEdge", e.ID()) }
+func (s *fakeChangeSink) DropVertex(v *Vertex) error        { return s.record("DropVertex", v.ID()) }
+func (s *fakeChangeSink) DropEdge(e *Edge) error            { return s.record("DropEdge", e.ID()) }
+
+// fakeSink can only take the whole graph, it records the number of vertices and edges.
+type fakeSink struct {
+	calls []string
+}
+
+func (s *fakeSink) WriteGraph(g *graph) error {
+	vc, ec := g.counts()
+	s.calls = append(s.calls, fmt.Sprintf("WriteGraph %d %d", vc["user"]+vc["group"], ec["in"]))
+	return nil
+}
+
+func (s *fakeSink) Close() error { return nil }
+
+func buildGraph(t *testing.T, vertices []*Vertex, edges []*Edge) *graph {
+	g := newGraph()
+	for _, v := range vertices {
+		if _, err := g.upsertVertex(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, e := range edges {
+		if _, err := g.upsertEdge(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return g
+}
+
+// diffTestGraphs are two crawls: between them bob left the account (and eng), carol
+// joined eng, alice was suspended, dave became an OWNER of eng and the order alice's
+// aliases and eng's properties were read in changed.
+func diffTestGraphs(t *testing.T) (old, cur *graph) {
+	alice, bob, carol, dave, eng := "alice@example.com", "bob@example.com", "carol@example.com", "dave@example.com", "eng@example.com"
+	old = buildGraph(t, []*Vertex{
+		userVertex(alice).set("suspended", false).set("aliases", []string{"a@example.com", "al@example.com"}),
+		userVertex(bob).set("suspended", false),
+		userVertex(dave).set("suspended", false),
+		groupVertex(eng).set("name", "Eng").set("directMembersCount", int64(3)),
+	}, []*Edge{
+		inEdge(userVertex(alice), groupVertex(eng)).set("role", "MEMBER"),
+		inEdge(userVertex(bob), groupVertex(eng)).set("role", "MEMBER"),
+		inEdge(userVertex(dave), groupVertex(eng)).set("role", "MEMBER"),
+	})
+	cur = buildGraph(t, []*Vertex{
+		userVertex(alice).set("aliases", []string{"al@example.com", "a@example.com"}).set("suspended", true),
+		userVertex(carol).set("suspended", false),
+		userVertex(dave).set("suspended", false),
+		groupVertex(eng).set("directMembersCount", int64(3)).set("name", "Eng"),
+	}, []*Edge{
+		inEdge(userVertex(alice), groupVertex(eng)).set("role", "MEMBER"),
+		inEdge(userVertex(carol), groupVertex(eng)).set("role", "MEMBER"),
+		inEdge(userVertex(dave), groupVertex(eng)).set("role", "OWNER"),
+	})
+	return old, cur
+}
+
+func TestWriteChanges(t *testing.T) {
+	old, cur := diffTestGraphs(t)
+	d := diffGraphs(old, cur)
+	if added, changed, removed := d.counts(); added != 2 || changed != 2 || removed != 2 {
+		t.Errorf("%d added, %d changed, %d removed, want 2 of each", added, changed, removed)
+	}
+
+	s := &fakeChangeSink{}
+	if err := writeChanges(s, d, cur); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"DropEdge user:bob@example.com-in->group:eng@example.com",
+		"DropVertex user:bob@example.com",
+		"UpdateVertex user:alice@example.com",
+		"UpsertVertex user:carol@example.com",
+		"UpsertEdge user:carol@example.com-in->group:eng@example.com",
+		"UpdateEdge user:dave@example.com-in->group:eng@example.com",
+		"Flush ",
+	}
+	if !reflect.DeepEqual(s.calls, want) {
+		t.Errorf("got calls\n\t%s\nwant\n\t%s", strings.Join(s.calls, "\n\t"), strings.Join(want, "\n\t"))
+	}
+}
+
+func TestWriteChangesWholeGraph(t *testing.T) {
+	old, cur := diffTestGraphs(t)
+	d := diffGraphs(old, cur)
+
+	changes, whole := &fakeChangeSink{}, &fakeSink{}
+	if err := writeChanges(multiSink{changes, whole}, d, cur); err != nil {
+		t.Fatal(err)
+	}
+	if len(changes.calls) != 7 {
+		t.Errorf("the change sink got %v, want the 7 changes", changes.calls)
+	}
+	if want := []string{"WriteGraph 4 3"}; !reflect.DeepEqual(whole.calls, want) {
+		t.Errorf("the other sink got %v, want %v", whole.calls, want)
+	}
+}
+
+func TestDiffIdentical(t *testing.T) {
+	old, _ := diffTestGraphs(t)
+	same, _ := diffTestGraphs(t)
+	if d := diffGraphs(old, same); len(d.vertices)+len(d.edges) != 0 {
+		t.Errorf("identical graphs differ: %+v", d)
+	}
+}
+
+// After a failed crawl nothing is removed: the removals are dropped from the diff and
+// what was removed is put back in the current graph.
+func TestKeepRemoved(t *testing.T) {
+	old, cur := diffTestGraphs(t)
+	d := diffGraphs(old, cur)
+	d.keepRemoved(cur)
+	if added, changed, removed := d.counts(); added != 2 || changed != 2 || removed != 0 {
+		t.Errorf("%d added, %d changed, %d removed, want 2, 2 and 0", added, changed, removed)
+	}
+	if _, ok := cur.vertices["user:bob@example.com"]; !ok {
+		t.Errorf("bob is not back in the graph")
+	}
+	if _, ok := cur.edges["user:bob@example.com-in->group:eng@example.com"]; !ok {
+		t.Errorf("bob's membership is not back in the graph")
+	}
+
+	s := &fakeChangeSink{}
+	if err := writeChanges(s, d, cur); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range s.calls {
+		if strings.HasPrefix(c, "Drop") {
+			t.Errorf("%s after keepRemoved", c)
+		}
+	}
+}
+
+func TestSameProperties(t *testing.T) {
+	p := func(kv ...interface{}) []Property {
+		var props []Property
+		for i := 0; i < len(kv); i += 2 {
+			props = append(props, Property{kv[i].(string), kv[i+1]})
+		}
+		return props
+	}
+	for _, tc := range []struct {
+		a, b []Property
+		same bool
+	}{
+		{nil, nil, true},
+		{p("a", "x", "b", true), p("b", true, "a", "x"), true},
+		{p("l", []string{"x", "y"}), p("l", []string{"y", "x"}), true},
+		{p("l", []string{"x", "y"}), p("l", []string{"x"}), false},
+		{p("l", []string{"x", "x"}), p("l", []string{"x", "y"}), false},
+		{p("a", "x"), p("a", "y"), false},
+		{p("a", "x"), p("b", "x"), false},
+		{p("a", "x"), p("a", "x", "b", "y"), false},
+		{p("n", 1), p("n", int64(1)), false},
+		{p("n", false), p("n", "false"), false},
+	} {
+		if got := sameProperties(tc.a, tc.b); got != tc.same {
+			t.Errorf("sameProperties(%v, %v) = %v, want %v", tc.a, tc.b, got, tc.same)
+		}
+	}
+}
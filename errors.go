@@ -0,0 +1,90 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"sort"
+	"sync"
+
+	"github.com/golang/glog"
+	"google.golang.org/api/googleapi"
+)
+
+// CrawlError is an API call that failed for one resource (eg, a project with the IAM
+// API disabled).  The resource is left out of the graph and the run carries on.
+type CrawlError struct {
+	Component string `json:"component"`
+	Resource  string `json:"resource"`
+	Code      int    `json:"code,omitempty"`
+	Message   string `json:"message"`
+}
+
+var (
+	emutex      = &sync.Mutex{}
+	crawlErrors []CrawlError
+)
+
+// addError records that loading resource (eg, projects/my-project) for component
+// (eg, projectIAM) failed with err.
+func addError(component, resource string, err error) {
+	glog.Errorf("%s %s: %v", component, resource, err)
+	ce := CrawlError{Component: component, Resource: resource, Message: err.Error()}
+	if gerr, ok := err.(*googleapi.Error); ok {
+		ce.Code = gerr.Code
+	}
+	emutex.Lock()
+	defer emutex.Unlock()
+	crawlErrors = append(crawlErrors, ce)
+}
+
+// errorCount is the number of resources that failed so far.
+func errorCount() int {
+	emutex.Lock()
+	defer emutex.Unlock()
+	return len(crawlErrors)
+}
+
+// writeErrors logs a summary of the failed resources per component and, if path is
+// set, writes them all as JSON.
+func writeErrors(path string) error {
+	emutex.Lock()
+	defer emutex.Unlock()
+	sort.SliceStable(crawlErrors, func(i, j int) bool {
+		if crawlErrors[i].Component != crawlErrors[j].Component {
+			return crawlErrors[i].Component < crawlErrors[j].Component
+		}
+		return crawlErrors[i].Resource < crawlErrors[j].Resource
+	})
+	if len(crawlErrors) == 0 {
+		glog.V(2).Infof(">>>>>>>>>>> No errors")
+	} else {
+		glog.Warningf(">>>>>>>>>>> %d resources failed to load", len(crawlErrors))
+	}
+	for _, e := range crawlErrors {
+		glog.Warningf("     %s %s: %s", e.Component, e.Resource, e.Message)
+	}
+	if path == "" {
+		return nil
+	}
+	// an empty report is [] rather than null
+	report := append([]CrawlError{}, crawlErrors...)
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
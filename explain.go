@@ -0,0 +1,261 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+)
+
+// The kinds of hop in an access path
+const (
+	hopMembership  = "membership"  // member -> group
+	hopBinding     = "binding"     // member -> IAM binding
+	hopGrant       = "grant"       // binding -> the resource whose policy has it
+	hopInheritance = "inheritance" // resource -> a resource below it
+)
+
+// accessHop is one step from a principal to a resource.
+type accessHop struct {
+	Kind      string `json:"kind"`
+	From      string `json:"from"`
+	To        string `json:"to"`
+	Role      string `json:"role,omitempty"`
+	Condition string `json:"condition,omitempty"`
+	// MemberRole is the member's role in the group (OWNER, MANAGER or MEMBER), for a membership
+	MemberRole string `json:"memberRole,omitempty"`
+}
+
+// accessPath is one way a principal reaches a resource.
+type accessPath struct {
+	Role      string `json:"role"`
+	Condition string `json:"condition,omitempty"`
+	Shortest  bool   `json:"shortest"`
+	// Manages is the group the principal owns or manages on the path (see --escalation)
+	Manages string      `json:"manages,omitempty"`
+	Hops    []accessHop `json:"hops"`
+}
+
+// explanation is every distinct path from a principal to a resource.
+type explanation struct {
+	Principal string       `json:"principal"`
+	Resource  string       `json:"resource"`
+	Paths     []accessPath `json:"paths"`
+}
+
+// ancestorPaths maps each resource the resource inherits from to the chain from the
+// resource up to it.
+func (x *graphIndex) ancestorPaths(v *Vertex) map[string][]*Vertex {
+	paths := map[string][]*Vertex{v.ID(): {v}}
+	queue := []*Vertex{v}
+	for len(queue) > 0 {
+		cur := queue[0]
+		queue = queue[1:]
+		for _, e := range x.out[cur.ID()] {
+			if !isResource(e.To.Label) {
+				continue
+			}
+			if _, ok := paths[e.To.ID()]; ok {
+				continue
+			}
+			p := append(append([]*Vertex{}, paths[cur.ID()]...), e.To)
+			paths[e.To.ID()] = p
+			queue = append(queue, e.To)
+		}
+	}
+	return paths
+}
+
+// explain returns every distinct path from the principal to the resource (through
+// nested groups, a binding and the resource hierarchy), shortest first.
+func (x *graphIndex) explain(principal, resource *Vertex) *explanation {
+	ex := &explanation{Principal: principal.ID(), Resource: resource.ID(), Paths: []accessPath{}}
+	up := x.ancestorPaths(resource)
+
+	x.bindingsOf(principal, func(path []*Vertex) {
+		b := path[len(path)-1]
+		role, condition := stringProperty(b, "role"), stringProperty(b, "condition")
+		for _, e := range x.out[b.ID()] {
+			chain, ok := up[e.To.ID()]
+			if !ok || !isResource(e.To.Label) {
+				continue
+			}
+			p := accessPath{Role: role, Condition: condition, Manages: x.manages(path)}
+			for i := 0; i+1 < len(path); i++ {
+				h := accessHop{Kind: hopMembership, From: path[i].ID(), To: path[i+1].ID()}
+				if path[i+1].Label == "binding" {
+					h.Kind = hopBinding
+				} else {
+					h.MemberRole = x.membershipRole(path[i], path[i+1])
+				}
+				p.Hops = append(p.Hops, h)
+			}
+			p.Hops = append(p.Hops, accessHop{Kind: hopGrant, From: b.ID(), To: e.To.ID(), Role: role, Condition: condition})
+			for i := len(chain) - 1; i > 0; i-- {
+				p.Hops = append(p.Hops, accessHop{Kind: hopInheritance, From: chain[i].ID(), To: chain[i-1].ID()})
+			}
+			ex.Paths = append(ex.Paths, p)
+		}
+	})
+
+	sort.SliceStable(ex.Paths, func(i, j int) bool { return len(ex.Paths[i].Hops) < len(ex.Paths[j].Hops) })
+	for i := range ex.Paths {
+		ex.Paths[i].Shortest = len(ex.Paths[i].Hops) == len(ex.Paths[0].Hops)
+	}
+	return ex
+}
+
+// onlyShortest drops all but the shortest paths.
+func (ex *explanation) onlyShortest() {
+	paths := ex.Paths[:0]
+	for _, p := range ex.Paths {
+		if p.Shortest {
+			paths = append(paths, p)
+		}
+	}
+	ex.Paths = paths
+}
+
+func (ex *explanation) writeText(w io.Writer) {
+	if len(ex.Paths) == 0 {
+		fmt.Fprintf(w, "%s has no access to %s\n", ex.Principal, ex.Resource)
+		return
+	}
+	fmt.Fprintf(w, "%s has access to %s through %d path(s)\n", ex.Principal, ex.Resource, len(ex.Paths))
+	for i, p := range ex.Paths {
+		fmt.Fprintf(w, "\npath %d: %s", i+1, p.Role)
+		if p.Condition != "" {
+			fmt.Fprintf(w, " if %s", p.Condition)
+		}
+		if p.Shortest {
+			fmt.Fprint(w, " (shortest)")
+		}
+		if p.Manages != "" {
+			fmt.Fprintf(w, ", can grant it by adding members to %s", p.Manages)
+		}
+		fmt.Fprintf(w, "\n  %s\n", ex.Principal)
+		for _, h := range p.Hops {
+			switch h.Kind {
+			case hopMembership:
+				fmt.Fprintf(w, "    %s of %s\n", memberRoleName(h.MemberRole), h.To)
+			case hopBinding:
+				fmt.Fprintf(w, "    member of %s\n", h.To)
+			case hopGrant:
+				fmt.Fprintf(w, "    grants %s on %s", h.Role, h.To)
+				if h.Condition != "" {
+					fmt.Fprintf(w, " if %s", h.Condition)
+				}
+				fmt.Fprintln(w)
+			case hopInheritance:
+				fmt.Fprintf(w, "    inherited by %s\n", h.To)
+			}
+		}
+	}
+}
+
+func memberRoleName(role string) string {
+	switch role {
+	case "OWNER":
+		return "owner"
+	case "MANAGER":
+		return "manager"
+	}
+	return "member"
+}
+
+// writeDOT writes the paths as a Graphviz graph; the hops of the shortest paths are bold.
+func (ex *explanation) writeDOT(w io.Writer) {
+	fmt.Fprintln(w, "digraph explain {")
+	fmt.Fprintln(w, "  rankdir=LR;")
+	fmt.Fprintln(w, "  node [shape=box];")
+	fmt.Fprintf(w, "  %q [style=filled, fillcolor=lightblue];\n", ex.Principal)
+	fmt.Fprintf(w, "  %q [style=filled, fillcolor=lightgreen];\n", ex.Resource)
+
+	type edge struct{ from, to string }
+	var edges []edge
+	labels := make(map[edge]string)
+	bold := make(map[edge]bool)
+	for _, p := range ex.Paths {
+		for _, h := range p.Hops {
+			e := edge{h.From, h.To}
+			if _, ok := labels[e]; !ok {
+				edges = append(edges, e)
+				label := h.Kind
+				if h.MemberRole != "" {
+					label = memberRoleName(h.MemberRole)
+				}
+				if h.Kind == hopGrant {
+					label = h.Role
+					if h.Condition != "" {
+						label += "\nif " + h.Condition
+					}
+				}
+				labels[e] = label
+			}
+			bold[e] = bold[e] || p.Shortest
+		}
+	}
+	for _, e := range edges {
+		attrs := fmt.Sprintf("label=%q", labels[e])
+		if bold[e] {
+			attrs += ", style=bold"
+		}
+		fmt.Fprintf(w, "  %q -> %q [%s];\n", e.from, e.to, attrs)
+	}
+	fmt.Fprintln(w, "}")
+}
+
+// runExplain is the explain command: why a principal has access to a resource.
+func runExplain(args []string) error {
+	fs := newQueryFlags("explain", "<principal> <projects/ID|buckets/NAME|folders/ID|organizations/ID>", "text", "json", "dot")
+	shortest := fs.Bool("shortest", false, "only the shortest paths")
+	if err := fs.parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return fmt.Errorf("explain needs a principal and a resource")
+	}
+
+	x, err := fs.index()
+	if err != nil {
+		return err
+	}
+	principal, err := x.principal(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	resource, err := x.resource(fs.Arg(1))
+	if err != nil {
+		return err
+	}
+	ex := x.explain(principal, resource)
+	if *shortest {
+		ex.onlyShortest()
+	}
+
+	return fs.write(func(w io.Writer) error {
+		switch *fs.format {
+		case "json":
+			return writeJSON(w, ex)
+		case "dot":
+			ex.writeDOT(w)
+			return nil
+		}
+		ex.writeText(w)
+		return nil
+	})
+}
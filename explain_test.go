@@ -0,0 +1,111 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// pathString renders a path as "role: kind from>to, ..." with the member roles,
+// conditions and shortest flag.
+func pathString(p accessPath) string {
+	hops := make([]string, len(p.Hops))
+	for i, h := range p.Hops {
+		hops[i] = fmt.Sprintf("%s %s>%s", h.Kind, h.From, h.To)
+		if h.MemberRole != "" {
+			hops[i] += " as " + h.MemberRole
+		}
+	}
+	s := p.Role + ": " + strings.Join(hops, ", ")
+	if p.Condition != "" {
+		s += " if " + p.Condition
+	}
+	if p.Manages != "" {
+		s += " manages " + p.Manages
+	}
+	if !p.Shortest {
+		s += " (longer)"
+	}
+	return s
+}
+
+func TestExplain(t *testing.T) {
+	x := newGraphIndex(testGraph())
+	const (
+		alice = "user:alice@example.com"
+		eng   = "group:eng@example.com"
+		team  = "group:team@example.com"
+		org   = "organization:organizations/1"
+		orgB  = "binding:organization:organizations/1/roles/viewer"
+		p1B   = "binding:project:p1/roles/owner"
+		b1B   = "binding:bucket:b1/roles/storage.objectViewer"
+	)
+	inherited := ", inheritance organization:organizations/1>folder:folders/2, inheritance folder:folders/2>project:p1"
+	for _, tc := range []struct {
+		principal, resource string
+		escalation          bool
+		want                []string
+	}{
+		{
+			"alice@example.com", "buckets/b1", false, []string{
+				"roles/viewer: membership " + alice + ">" + eng + " as OWNER, membership " + eng + ">" + team + " as MEMBER, binding " + team + ">" + orgB +
+					", grant " + orgB + ">" + org + inherited + ", inheritance project:p1>bucket:b1",
+			},
+		},
+		{
+			"alice@example.com", "projects/p1", true, []string{
+				"roles/viewer: membership " + alice + ">" + eng + " as OWNER, membership " + eng + ">" + team + " as MEMBER, binding " + team + ">" + orgB +
+					", grant " + orgB + ">" + org + inherited + " manages " + eng,
+			},
+		},
+		{
+			// the owner role on the project and the bucket role through projectOwner:p1
+			"bob@example.com", "buckets/b1", false, []string{
+				"roles/owner: binding user:bob@example.com>" + p1B + ", grant " + p1B + ">project:p1, inheritance project:p1>bucket:b1",
+				"roles/storage.objectViewer: binding user:bob@example.com>" + p1B + ", binding " + p1B + ">" + b1B + ", grant " + b1B + ">bucket:b1",
+			},
+		},
+		{
+			"dave@other.com", "projects/p1", false, []string{
+				"roles/editor: binding user:dave@other.com>binding:project:p1/roles/editor?" + conditionHash(testCondition) +
+					", grant binding:project:p1/roles/editor?" + conditionHash(testCondition) + ">project:p1 if " + testCondition,
+				"roles/viewer: membership user:dave@other.com>" + eng + " as MEMBER, membership " + eng + ">" + team + " as MEMBER, binding " + team + ">" + orgB +
+					", grant " + orgB + ">" + org + inherited + " (longer)",
+			},
+		},
+		{"dave@other.com", "projects/p2", false, []string{
+			"roles/viewer: membership user:dave@other.com>" + eng + " as MEMBER, membership " + eng + ">" + team + " as MEMBER, binding " + team + ">" + orgB +
+				", grant " + orgB + ">" + org + ", inheritance organization:organizations/1>project:p2",
+		}},
+		{"carol@example.com", "organizations/1", false, nil},
+	} {
+		x.escalation = tc.escalation
+		principal, err := x.principal(tc.principal)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resource, err := x.resource(tc.resource)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, p := range x.explain(principal, resource).Paths {
+			got = append(got, pathString(p))
+		}
+		checkStrings(t, tc.principal+" on "+tc.resource, got, tc.want)
+	}
+}
@@ -0,0 +1,260 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+)
+
+// orgDomains are the customer's verified domains (primary, secondary and aliases);
+// nil if they could not be listed.
+var orgDomains map[string]bool
+
+// getDomains lists the customer's domains, which tell internal users and groups from
+// external ones, and records them on the organization vertex.  Without them the
+// principals are just not classified, so a failure is not a crawl error.
+func getDomains(ctx context.Context) {
+	glog.V(2).Infoln(">>>>>>>>>>> Getting Domains")
+	r, err := domainService.Domains.List(*cx).Context(ctx).Do()
+	if err != nil {
+		glog.Warningf("Could not list the domains of customers/%s: %v", *cx, err)
+		return
+	}
+	orgDomains = make(map[string]bool)
+	var names []string
+	for _, d := range r.Domains {
+		if !d.Verified {
+			continue
+		}
+		glog.V(4).Infof("            Adding Domain %v (primary %v)", d.DomainName, d.IsPrimary)
+		orgDomains[strings.ToLower(d.DomainName)] = true
+		names = append(names, d.DomainName)
+		for _, a := range d.DomainAliases {
+			if a.Verified {
+				orgDomains[strings.ToLower(a.DomainAliasName)] = true
+				names = append(names, a.DomainAliasName)
+			}
+		}
+	}
+	sort.Strings(names)
+	upsertVertex(organizationVertex(fmt.Sprintf("organizations/%s", *organization)).set("domains", names))
+	// domain -in-> customer: everyone in the account is everyone in its domains
+	upsertVertex(customerVertex(*cx).set("isExternal", false))
+	for _, name := range names {
+		upsertEdge(inEdge(domainVertex(strings.ToLower(name)), customerVertex(*cx)))
+	}
+}
+
+// classifyPrincipals sets isExternal on every user, group and service account in the
+// graph: users and groups by the domain of their email, service accounts by whether
+// the project they belong to is in the organization (ownerProject is that project,
+// if the email tells it).
+func classifyPrincipals(g *graph) {
+	if orgDomains == nil {
+		glog.Warningf("The customer's domains are unknown, users and groups are not classified as internal or external")
+	}
+	inOrg := make(map[string]string)
+	for _, p := range projects {
+		inOrg[p.ProjectId] = p.ProjectId
+		inOrg[strconv.FormatInt(p.ProjectNumber, 10)] = p.ProjectId
+	}
+
+	var internal, external int
+	for _, v := range g.sortedVertices() {
+		email := fmt.Sprint(v.Key[0].Value)
+		classified := newVertex(v.Label, v.Key[0].Key, email)
+		var isExternal bool
+		switch v.Label {
+		case "user", "group":
+			if orgDomains == nil {
+				continue
+			}
+			isExternal = !orgDomains[emailDomain(email)]
+		case "domain":
+			if orgDomains == nil {
+				continue
+			}
+			isExternal = !orgDomains[email]
+		case "customer":
+			isExternal = email != *cx
+		case "serviceAccount":
+			owner := serviceAccountProject(email)
+			id, ok := inOrg[owner]
+			isExternal = !ok
+			if ok {
+				owner = id
+			}
+			if owner != "" {
+				classified.set("ownerProject", owner)
+			}
+		default:
+			continue
+		}
+		if isExternal {
+			external++
+		} else {
+			internal++
+		}
+		if _, err := g.upsertVertex(classified.set("isExternal", isExternal)); err != nil {
+			glog.Error(err)
+		}
+	}
+	glog.V(2).Infof(">>>>>>>>>>> %d internal and %d external principals", internal, external)
+}
+
+// emailDomain is the lowercase domain of an email; allUsers and allAuthenticatedUsers
+// have none, so they are always external.
+func emailDomain(email string) string {
+	i := strings.LastIndex(email, "@")
+	if i < 0 {
+		return ""
+	}
+	return strings.ToLower(email[i+1:])
+}
+
+// google managed service accounts named after the project number, eg.
+// 123-compute@developer.gserviceaccount.com or service-123@gcp-sa-pubsub.iam.gserviceaccount.com
+var projectNumberAccount = regexp.MustCompile(`^(?:service-)?(\d+)(?:-compute)?@`)
+
+// serviceAccountProject returns the id (or number) of the project a service account
+// belongs to, or "" if its email doesn't tell.
+func serviceAccountProject(email string) string {
+	if m := projectNumberAccount.FindStringSubmatch(email); m != nil {
+		return m[1]
+	}
+	// workload identity, eg. my-project.svc.id.goog[namespace/ksa]
+	if i := strings.Index(email, ".svc.id.goog["); i > 0 {
+		return email[:i]
+	}
+	domain := emailDomain(email)
+	switch {
+	case strings.HasSuffix(domain, ".iam.gserviceaccount.com"):
+		return strings.TrimSuffix(domain, ".iam.gserviceaccount.com")
+	case domain == "appspot.gserviceaccount.com":
+		return strings.SplitN(email, "@", 2)[0]
+	}
+	return ""
+}
+
+// externalPrincipal is an external user, group or service account and the access it has.
+type externalPrincipal struct {
+	Principal    string `json:"principal"`
+	OwnerProject string `json:"ownerProject,omitempty"`
+	// Groups are the groups it is a direct member of
+	Groups []string `json:"groups"`
+	// Grants are the roles it holds, directly or through groups, where they are granted
+	Grants []accessGrant `json:"grants"`
+}
+
+// externalAccess returns every principal marked isExternal with its group memberships
+// and IAM grants.
+func (x *graphIndex) externalAccess() []externalPrincipal {
+	var report []externalPrincipal
+	for _, v := range x.g.sortedVertices() {
+		if !isPrincipal(v.Label) {
+			continue
+		}
+		if i := findProperty(v.Properties, "isExternal"); i < 0 || v.Properties[i].Value != true {
+			continue
+		}
+		p := externalPrincipal{
+			Principal:    v.ID(),
+			OwnerProject: stringProperty(v, "ownerProject"),
+			Groups:       []string{},
+			Grants:       []accessGrant{},
+		}
+		for _, e := range x.out[v.ID()] {
+			if e.To.Label == "group" {
+				p.Groups = append(p.Groups, e.To.ID())
+			}
+		}
+		x.bindingsOf(v, func(path []*Vertex) {
+			b := path[len(path)-1]
+			ids := make([]string, 0, len(path)+1)
+			for _, pv := range path {
+				ids = append(ids, pv.ID())
+			}
+			on := stringProperty(b, "resource")
+			p.Grants = append(p.Grants, accessGrant{
+				Principal: v.ID(),
+				Role:      stringProperty(b, "role"),
+				Resource:  on,
+				GrantedOn: on,
+				Condition: stringProperty(b, "condition"),
+				Path:      append(ids, on),
+				Manages:   x.manages(path),
+			})
+		})
+		report = append(report, p)
+	}
+	return report
+}
+
+// runExternal is the external command: every external principal and its access.
+func runExternal(args []string) error {
+	fs := newQueryFlags("external", "", "text", "json")
+	if err := fs.parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 {
+		fs.Usage()
+		return fmt.Errorf("external takes no arguments")
+	}
+
+	x, err := fs.index()
+	if err != nil {
+		return err
+	}
+	report := x.externalAccess()
+
+	return fs.write(func(w io.Writer) error {
+		if *fs.format == "json" {
+			if report == nil {
+				report = []externalPrincipal{}
+			}
+			return writeJSON(w, report)
+		}
+		fmt.Fprintf(w, "%d external principals\n", len(report))
+		for _, p := range report {
+			fmt.Fprintf(w, "\n%s", p.Principal)
+			if p.OwnerProject != "" {
+				fmt.Fprintf(w, " (project %s)", p.OwnerProject)
+			}
+			fmt.Fprintln(w)
+			for _, g := range p.Groups {
+				fmt.Fprintf(w, "    member of %s\n", g)
+			}
+			for _, g := range p.Grants {
+				fmt.Fprintf(w, "    has %s on %s", g.Role, g.GrantedOn)
+				if g.Condition != "" {
+					fmt.Fprintf(w, " if %s", g.Condition)
+				}
+				if g.Manages != "" {
+					fmt.Fprintf(w, " and can grant it by adding members to %s", g.Manages)
+				}
+				fmt.Fprintf(w, "\n        %s\n", strings.Join(g.Path, " -in-> "))
+			}
+		}
+		return nil
+	})
+}
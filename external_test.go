@@ -0,0 +1,53 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestExternalAccess(t *testing.T) {
+	g := testGraph()
+	upsertGraph := func(v *Vertex) {
+		if _, err := g.upsertVertex(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// an external account's users are external too, but it has no grants here
+	upsertGraph(customerVertex("C9").set("isExternal", true))
+	x := newGraphIndex(g)
+
+	report := x.externalAccess()
+	var principals []string
+	for _, p := range report {
+		principals = append(principals, p.Principal)
+	}
+	if want := []string{"customer:C9", "user:dave@other.com"}; !reflect.DeepEqual(principals, want) {
+		t.Fatalf("external principals are %v, want %v", principals, want)
+	}
+	if len(report[0].Groups) != 0 || len(report[0].Grants) != 0 {
+		t.Errorf("customer:C9 has groups %v and grants %v, want none", report[0].Groups, report[0].Grants)
+	}
+
+	dave := report[1]
+	if want := []string{"group:eng@example.com"}; !reflect.DeepEqual(dave.Groups, want) {
+		t.Errorf("dave is in %v, want %v", dave.Groups, want)
+	}
+	checkStrings(t, "dave's grants", grantStrings(dave.Grants), []string{
+		"user:dave@other.com binding:project:p1/roles/editor?" + conditionHash(testCondition) + " project:p1 if " + testCondition,
+		"user:dave@other.com group:eng@example.com group:team@example.com " + orgViewer,
+	})
+}
@@ -0,0 +1,62 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"sync"
+
+	"github.com/golang/glog"
+)
+
+// Finding is something noteworthy discovered while crawling (eg, a group membership
+// cycle) that is reported at the end of the run.
+type Finding struct {
+	Kind     string   `json:"kind"`
+	Message  string   `json:"message"`
+	Subjects []string `json:"subjects,omitempty"`
+}
+
+var (
+	fmutex   = &sync.Mutex{}
+	findings []Finding
+)
+
+func addFinding(kind, message string, subjects ...string) {
+	glog.Warningf("Finding %s: %s %v", kind, message, subjects)
+	fmutex.Lock()
+	defer fmutex.Unlock()
+	findings = append(findings, Finding{Kind: kind, Message: message, Subjects: subjects})
+}
+
+// writeFindings logs every finding and, if path is set, writes them as JSON.
+func writeFindings(path string) error {
+	fmutex.Lock()
+	defer fmutex.Unlock()
+	glog.V(2).Infof(">>>>>>>>>>> %d findings", len(findings))
+	for _, f := range findings {
+		glog.Infof("     %s: %s %v", f.Kind, f.Message, f.Subjects)
+	}
+	if path == "" {
+		return nil
+	}
+	// no findings is [] rather than null
+	data, err := json.MarshalIndent(append([]Finding{}, findings...), "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
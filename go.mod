@@ -1,11 +1,12 @@
-module main
+module github.com/salrashid123/gsuites_gcp_graphdb
 
 go 1.15
 
 require (
-	cloud.google.com/go/storage v1.13.0 // indirect
-	golang.org/x/net v0.0.0-20210119194325-5f4716e94777 // indirect
-	golang.org/x/oauth2 v0.0.0-20210210192628-66670185b0cd // indirect
-	golang.org/x/time v0.0.0-20201208040808-7e3f01d25324 // indirect
-	google.golang.org/api v0.40.0 // indirect
+	cloud.google.com/go/storage v1.13.0
+	github.com/golang/glog v0.0.0-20160126235308-23def4e6c14b
+	golang.org/x/net v0.0.0-20210119194325-5f4716e94777
+	golang.org/x/oauth2 v0.0.0-20210210192628-66670185b0cd
+	golang.org/x/time v0.0.0-20201208040808-7e3f01d25324
+	google.golang.org/api v0.40.0
 )
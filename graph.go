@@ -0,0 +1,414 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/golang/glog"
+)
+
+// ID is derived from the label and natural key only, so the same user, group, role...
+// gets the same id on every run (eg, user:alice@example.com).
+func (v *Vertex) ID() string {
+	vals := make([]string, len(v.Key))
+	for i, k := range v.Key {
+		vals[i] = fmt.Sprint(k.Value)
+	}
+	return v.Label + ":" + strings.Join(vals, "/")
+}
+
+func (e *Edge) ID() string {
+	return e.From.ID() + "-" + e.Label + "->" + e.To.ID()
+}
+
+// graph is the in-memory property graph the collectors populate; every sink is fed
+// from it once the crawl is done.  Vertices are keyed by their id (label + natural key)
+// so repeated upserts are merged here rather than guarded in each output: scalar
+// properties take the latest value, multi-valued ([]string) properties accumulate.
+type graph struct {
+	mu       sync.Mutex
+	vertices map[string]*Vertex
+	edges    map[string]*Edge
+}
+
+func newGraph() *graph {
+	return &graph{
+		vertices: make(map[string]*Vertex),
+		edges:    make(map[string]*Edge),
+	}
+}
+
+func (g *graph) upsertVertex(v *Vertex) (*Vertex, error) {
+	if err := v.validate(); err != nil {
+		return nil, err
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.upsertVertexLocked(v), nil
+}
+
+func (g *graph) upsertVertexLocked(v *Vertex) *Vertex {
+	id := v.ID()
+	cur, ok := g.vertices[id]
+	if !ok {
+		cur = &Vertex{Label: v.Label, Key: v.Key}
+		g.vertices[id] = cur
+	}
+	cur.Properties = mergeProperties(cur.Properties, v.Properties)
+	return cur
+}
+
+// upsertEdge adds the edge, creating key-only endpoints if they have not been seen yet.
+func (g *graph) upsertEdge(e *Edge) (*Edge, error) {
+	if e.Label == "" {
+		return nil, fmt.Errorf("edge %s has no label", e.ID())
+	}
+	if err := e.From.validate(); err != nil {
+		return nil, err
+	}
+	if err := e.To.validate(); err != nil {
+		return nil, err
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	from := g.upsertVertexLocked(&Vertex{Label: e.From.Label, Key: e.From.Key})
+	to := g.upsertVertexLocked(&Vertex{Label: e.To.Label, Key: e.To.Key})
+	id := e.ID()
+	cur, ok := g.edges[id]
+	if !ok {
+		cur = &Edge{Label: e.Label, From: from, To: to}
+		g.edges[id] = cur
+	}
+	cur.Properties = mergeProperties(cur.Properties, e.Properties)
+	return cur, nil
+}
+
+func (v *Vertex) validate() error {
+	if v.Label == "" || len(v.Key) == 0 {
+		return fmt.Errorf("vertex %s has no label or key", v.ID())
+	}
+	for _, k := range v.Key {
+		if k.Key == "" || k.Value == nil || k.Value == "" {
+			return fmt.Errorf("vertex %s has an empty key", v.ID())
+		}
+	}
+	return nil
+}
+
+// sortedVertices returns the vertices ordered by id so exports are stable between runs.
+func (g *graph) sortedVertices() []*Vertex {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	vs := make([]*Vertex, 0, len(g.vertices))
+	for _, v := range g.vertices {
+		vs = append(vs, v)
+	}
+	sort.Slice(vs, func(i, j int) bool { return vs[i].ID() < vs[j].ID() })
+	return vs
+}
+
+// verticesWithLabel returns copies of the vertices with the label, in no particular order.
+func (g *graph) verticesWithLabel(label string) []*Vertex {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	var vs []*Vertex
+	for _, v := range g.vertices {
+		if v.Label == label {
+			vs = append(vs, &Vertex{Label: v.Label, Key: v.Key, Properties: append([]Property{}, v.Properties...)})
+		}
+	}
+	return vs
+}
+
+func (g *graph) sortedEdges() []*Edge {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	es := make([]*Edge, 0, len(g.edges))
+	for _, e := range g.edges {
+		es = append(es, e)
+	}
+	sort.Slice(es, func(i, j int) bool { return es[i].ID() < es[j].ID() })
+	return es
+}
+
+// counts returns the number of vertices and edges per label.
+func (g *graph) counts() (map[string]int, map[string]int) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	vc := make(map[string]int)
+	for _, v := range g.vertices {
+		vc[v.Label]++
+	}
+	ec := make(map[string]int)
+	for _, e := range g.edges {
+		ec[e.Label]++
+	}
+	return vc, ec
+}
+
+// streamGraph sends the graph to the sink, every vertex before any edge so the sinks
+// can expect both ends of an edge to be there already.
+func streamGraph(s ChangeSink, g *graph) error {
+	var first error
+	for _, v := range g.sortedVertices() {
+		if err := s.UpsertVertex(v); err != nil {
+			glog.Error(err)
+			if first == nil {
+				first = err
+			}
+		}
+	}
+	for _, e := range g.sortedEdges() {
+		if err := s.UpsertEdge(e); err != nil {
+			glog.Error(err)
+			if first == nil {
+				first = err
+			}
+		}
+	}
+	if err := s.Flush(); err != nil && first == nil {
+		first = err
+	}
+	return first
+}
+
+func mergeProperties(cur, props []Property) []Property {
+	for _, p := range props {
+		i := findProperty(cur, p.Key)
+		if i < 0 {
+			if l, ok := p.Value.([]string); ok {
+				p.Value = append([]string{}, l...)
+			}
+			cur = append(cur, p)
+			continue
+		}
+		old, oldList := cur[i].Value.([]string)
+		add, addList := p.Value.([]string)
+		if oldList && addList {
+			for _, s := range add {
+				if _, ok := find(old, s); !ok {
+					old = append(old, s)
+				}
+			}
+			cur[i].Value = old
+			continue
+		}
+		cur[i].Value = p.Value
+	}
+	return cur
+}
+
+func findProperty(props []Property, key string) int {
+	for i, p := range props {
+		if p.Key == key {
+			return i
+		}
+	}
+	return -1
+}
+
+// allProperties returns the key followed by the other properties of a vertex.
+func (v *Vertex) allProperties() []Property {
+	return append(append([]Property{}, v.Key...), v.Properties...)
+}
+
+// jsonGraph is how the graph is saved to disk (see crawlState) with the type of every
+// property value, so it is read back exactly as the collectors built it.
+type jsonGraph struct {
+	Vertices []jsonVertex `json:"vertices"`
+	Edges    []jsonEdge   `json:"edges"`
+}
+
+type jsonVertex struct {
+	Label      string         `json:"label"`
+	Key        []jsonProperty `json:"key"`
+	Properties []jsonProperty `json:"properties,omitempty"`
+}
+
+type jsonEdge struct {
+	Label      string         `json:"label"`
+	From       jsonVertex     `json:"from"`
+	To         jsonVertex     `json:"to"`
+	Properties []jsonProperty `json:"properties,omitempty"`
+}
+
+type jsonProperty struct {
+	Key   string          `json:"key"`
+	Type  string          `json:"type,omitempty"` // empty for strings
+	Value json.RawMessage `json:"value"`
+}
+
+// toJSON copies the graph (under its lock, the collectors may still be running) in
+// a stable order.
+func (g *graph) toJSON() (*jsonGraph, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	vids := make([]string, 0, len(g.vertices))
+	for id := range g.vertices {
+		vids = append(vids, id)
+	}
+	sort.Strings(vids)
+	eids := make([]string, 0, len(g.edges))
+	for id := range g.edges {
+		eids = append(eids, id)
+	}
+	sort.Strings(eids)
+
+	jg := &jsonGraph{}
+	for _, id := range vids {
+		jv, err := vertexToJSON(g.vertices[id], true)
+		if err != nil {
+			return nil, err
+		}
+		jg.Vertices = append(jg.Vertices, jv)
+	}
+	for _, id := range eids {
+		e := g.edges[id]
+		je := jsonEdge{Label: e.Label}
+		var err error
+		if je.From, err = vertexToJSON(e.From, false); err != nil {
+			return nil, err
+		}
+		if je.To, err = vertexToJSON(e.To, false); err != nil {
+			return nil, err
+		}
+		if je.Properties, err = propertiesToJSON(e.Properties); err != nil {
+			return nil, err
+		}
+		jg.Edges = append(jg.Edges, je)
+	}
+	return jg, nil
+}
+
+// load upserts the saved vertices and edges into g.
+func (g *graph) load(jg *jsonGraph) error {
+	for _, jv := range jg.Vertices {
+		v, err := jv.vertex()
+		if err != nil {
+			return err
+		}
+		if _, err := g.upsertVertex(v); err != nil {
+			return err
+		}
+	}
+	for _, je := range jg.Edges {
+		e := &Edge{Label: je.Label}
+		var err error
+		if e.From, err = je.From.vertex(); err != nil {
+			return err
+		}
+		if e.To, err = je.To.vertex(); err != nil {
+			return err
+		}
+		if e.Properties, err = propertiesFromJSON(je.Properties); err != nil {
+			return err
+		}
+		if _, err := g.upsertEdge(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func vertexToJSON(v *Vertex, withProperties bool) (jsonVertex, error) {
+	jv := jsonVertex{Label: v.Label}
+	var err error
+	if jv.Key, err = propertiesToJSON(v.Key); err != nil {
+		return jv, err
+	}
+	if withProperties {
+		jv.Properties, err = propertiesToJSON(v.Properties)
+	}
+	return jv, err
+}
+
+func (jv jsonVertex) vertex() (*Vertex, error) {
+	v := &Vertex{Label: jv.Label}
+	var err error
+	if v.Key, err = propertiesFromJSON(jv.Key); err != nil {
+		return nil, err
+	}
+	v.Properties, err = propertiesFromJSON(jv.Properties)
+	return v, err
+}
+
+func propertiesToJSON(props []Property) ([]jsonProperty, error) {
+	var jps []jsonProperty
+	for _, p := range props {
+		jp := jsonProperty{Key: p.Key}
+		switch p.Value.(type) {
+		case string:
+		case bool:
+			jp.Type = "boolean"
+		case int:
+			jp.Type = "int"
+		case int64:
+			jp.Type = "long"
+		case []string:
+			jp.Type = "list"
+		default:
+			return nil, fmt.Errorf("property %s has unsupported type %T", p.Key, p.Value)
+		}
+		data, err := json.Marshal(p.Value)
+		if err != nil {
+			return nil, err
+		}
+		jp.Value = data
+		jps = append(jps, jp)
+	}
+	return jps, nil
+}
+
+func propertiesFromJSON(jps []jsonProperty) ([]Property, error) {
+	var props []Property
+	for _, jp := range jps {
+		var err error
+		p := Property{Key: jp.Key}
+		switch jp.Type {
+		case "":
+			var s string
+			err = json.Unmarshal(jp.Value, &s)
+			p.Value = s
+		case "boolean":
+			var b bool
+			err = json.Unmarshal(jp.Value, &b)
+			p.Value = b
+		case "int":
+			var i int
+			err = json.Unmarshal(jp.Value, &i)
+			p.Value = i
+		case "long":
+			var i int64
+			err = json.Unmarshal(jp.Value, &i)
+			p.Value = i
+		case "list":
+			var l []string
+			err = json.Unmarshal(jp.Value, &l)
+			p.Value = l
+		default:
+			err = fmt.Errorf("unsupported type %q", jp.Type)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("property %s: %v", jp.Key, err)
+		}
+		props = append(props, p)
+	}
+	return props, nil
+}
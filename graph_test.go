@@ -0,0 +1,104 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// A saved graph is read back with the same property types, so it diffs as unchanged.
+func TestSnapshotRoundTrip(t *testing.T) {
+	g := buildGraph(t, []*Vertex{
+		userVertex("alice@example.com").
+			set("name", "Alice").
+			set("suspended", false).
+			set("aliases", []string{"al@example.com", "a@example.com"}).
+			set("emptyList", []string{}).
+			set("count", 3).
+			set("created", int64(1<<40)),
+		roleVertex("roles/viewer").set("stage", "GA"),
+	}, []*Edge{
+		inEdge(userVertex("alice@example.com"), groupVertex("eng@example.com")).set("role", "OWNER").set("delivery", "ALL_MAIL"),
+		inEdge(permissionVertex("storage.buckets.list"), roleVertex("roles/viewer")),
+	})
+
+	path := filepath.Join(t.TempDir(), "snapshot.json")
+	if err := saveSnapshot(path, g); err != nil {
+		t.Fatal(err)
+	}
+	_, loaded, err := loadSnapshot(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := diffGraphs(g, loaded); len(d.vertices)+len(d.edges) != 0 {
+		t.Errorf("the loaded graph differs: %+v", d)
+	}
+	for id, v := range g.vertices {
+		lv, ok := loaded.vertices[id]
+		if !ok {
+			t.Errorf("%s is missing", id)
+			continue
+		}
+		if !reflect.DeepEqual(lv.Key, v.Key) || !reflect.DeepEqual(lv.Properties, v.Properties) {
+			t.Errorf("%s is read back as %#v %#v, want %#v %#v", id, lv.Key, lv.Properties, v.Key, v.Properties)
+		}
+	}
+	for id, e := range g.edges {
+		le, ok := loaded.edges[id]
+		if !ok {
+			t.Errorf("%s is missing", id)
+			continue
+		}
+		if !reflect.DeepEqual(le.Properties, e.Properties) {
+			t.Errorf("%s is read back with %#v, want %#v", id, le.Properties, e.Properties)
+		}
+	}
+	if len(loaded.vertices) != len(g.vertices) || len(loaded.edges) != len(g.edges) {
+		t.Errorf("loaded %d vertices and %d edges, want %d and %d", len(loaded.vertices), len(loaded.edges), len(g.vertices), len(g.edges))
+	}
+}
+
+func TestPropertiesJSON(t *testing.T) {
+	props := []Property{{"s", "it's"}, {"b", true}, {"i", -1}, {"l", int64(1) << 62}, {"list", []string{"x", "y"}}}
+	jps, err := propertiesToJSON(props)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(jps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var back []jsonProperty
+	if err := json.Unmarshal(data, &back); err != nil {
+		t.Fatal(err)
+	}
+	got, err := propertiesFromJSON(back)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, props) {
+		t.Errorf("read back %#v from %s, want %#v", got, data, props)
+	}
+
+	if _, err := propertiesToJSON([]Property{{"f", 1.5}}); err == nil {
+		t.Errorf("a float64 property is saved, want an error")
+	}
+	if _, err := propertiesFromJSON([]jsonProperty{{Key: "x", Type: "float", Value: json.RawMessage("1.5")}}); err == nil {
+		t.Errorf("an unknown type is loaded, want an error")
+	}
+}
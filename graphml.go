@@ -0,0 +1,146 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"encoding/xml"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// graphmlSink writes the graph as GraphML (same layout as TinkerPop's IoCore.graphml(),
+// labels in the labelV/labelE keys) so it can be opened in Cytoscape or Gephi directly.
+// GraphML can't hold multi-valued properties; those are written comma separated.
+type graphmlSink struct {
+	path string
+}
+
+func newGraphMLSink(path string) *graphmlSink {
+	return &graphmlSink{path: path}
+}
+
+// Close does nothing, WriteGraph writes and closes the file.
+func (s *graphmlSink) Close() error {
+	return nil
+}
+
+type graphmlKey struct {
+	name string
+	kind string // node or edge
+}
+
+// WriteGraph rewrites the file with the graph.
+func (s *graphmlSink) WriteGraph(g *graph) error {
+	vertices := g.sortedVertices()
+	edges := g.sortedEdges()
+
+	keys := map[graphmlKey]string{
+		{"labelV", "node"}: "string",
+		{"labelE", "edge"}: "string",
+	}
+	for _, v := range vertices {
+		for _, p := range v.allProperties() {
+			keys[graphmlKey{p.Key, "node"}] = graphmlType(p.Value)
+		}
+	}
+	for _, e := range edges {
+		for _, p := range e.Properties {
+			keys[graphmlKey{p.Key, "edge"}] = graphmlType(p.Value)
+		}
+	}
+	sorted := make([]graphmlKey, 0, len(keys))
+	for k := range keys {
+		sorted = append(sorted, k)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].kind != sorted[j].kind {
+			return sorted[i].kind > sorted[j].kind
+		}
+		return sorted[i].name < sorted[j].name
+	})
+
+	f, err := os.Create(s.path)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	fmt.Fprintln(w, `<?xml version="1.0" encoding="UTF-8"?>`)
+	fmt.Fprintln(w, `<graphml xmlns="http://graphml.graphdrawing.org/xmlns" xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance" xsi:schemaLocation="http://graphml.graphdrawing.org/xmlns http://graphml.graphdrawing.org/xmlns/1.1/graphml.xsd">`)
+	for _, k := range sorted {
+		fmt.Fprintf(w, "  <key id=\"%s\" for=\"%s\" attr.name=\"%s\" attr.type=\"%s\"/>\n", graphmlKeyID(k), k.kind, xmlEscape(k.name), keys[k])
+	}
+	fmt.Fprintln(w, `  <graph id="G" edgedefault="directed">`)
+	for _, v := range vertices {
+		fmt.Fprintf(w, "    <node id=\"%s\">\n", xmlEscape(v.ID()))
+		fmt.Fprintf(w, "      <data key=\"labelV\">%s</data>\n", xmlEscape(v.Label))
+		for _, p := range v.allProperties() {
+			fmt.Fprintf(w, "      <data key=\"%s\">%s</data>\n", graphmlKeyID(graphmlKey{p.Key, "node"}), xmlEscape(graphmlValue(p.Value)))
+		}
+		fmt.Fprintln(w, "    </node>")
+	}
+	for _, e := range edges {
+		fmt.Fprintf(w, "    <edge id=\"%s\" source=\"%s\" target=\"%s\">\n", xmlEscape(e.ID()), xmlEscape(e.From.ID()), xmlEscape(e.To.ID()))
+		fmt.Fprintf(w, "      <data key=\"labelE\">%s</data>\n", xmlEscape(e.Label))
+		for _, p := range e.Properties {
+			fmt.Fprintf(w, "      <data key=\"%s\">%s</data>\n", graphmlKeyID(graphmlKey{p.Key, "edge"}), xmlEscape(graphmlValue(p.Value)))
+		}
+		fmt.Fprintln(w, "    </edge>")
+	}
+	fmt.Fprintln(w, "  </graph>")
+	fmt.Fprintln(w, "</graphml>")
+
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// graphmlKeyID keeps node and edge keys apart in case the same property name is
+// used on both.
+func graphmlKeyID(k graphmlKey) string {
+	if k.name == "labelV" || k.name == "labelE" {
+		return k.name
+	}
+	return xmlEscape(k.kind + "_" + k.name)
+}
+
+func graphmlType(v interface{}) string {
+	switch v.(type) {
+	case bool:
+		return "boolean"
+	case int:
+		return "int"
+	case int64:
+		return "long"
+	}
+	return "string"
+}
+
+func graphmlValue(v interface{}) string {
+	if l, ok := v.([]string); ok {
+		return strings.Join(l, ",")
+	}
+	return fmt.Sprint(v)
+}
+
+func xmlEscape(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
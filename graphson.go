@@ -0,0 +1,135 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// graphsonSink writes the graph in the GraphSON 3.0 adjacency list format read by
+// TinkerPop's GraphSONReader (one vertex per line with its in and out edges), eg.
+// graph.io(IoCore.graphson()).readGraph("/tmp/graph.json").
+// Multi-valued properties ([]string) become one vertex property per value.
+type graphsonSink struct {
+	path string
+}
+
+func newGraphSONSink(path string) *graphsonSink {
+	return &graphsonSink{path: path}
+}
+
+// Close does nothing, WriteGraph writes and closes the file.
+func (s *graphsonSink) Close() error {
+	return nil
+}
+
+type graphsonVertex struct {
+	ID         string                              `json:"id"`
+	Label      string                              `json:"label"`
+	OutE       map[string][]graphsonEdge           `json:"outE,omitempty"`
+	InE        map[string][]graphsonEdge           `json:"inE,omitempty"`
+	Properties map[string][]graphsonVertexProperty `json:"properties,omitempty"`
+}
+
+type graphsonEdge struct {
+	ID         string                 `json:"id"`
+	InV        string                 `json:"inV,omitempty"`
+	OutV       string                 `json:"outV,omitempty"`
+	Properties map[string]interface{} `json:"properties,omitempty"`
+}
+
+type graphsonVertexProperty struct {
+	ID    string      `json:"id"`
+	Value interface{} `json:"value"`
+}
+
+// WriteGraph rewrites the file with the graph.
+func (s *graphsonSink) WriteGraph(g *graph) error {
+	vertices := g.sortedVertices()
+	out := make(map[string]*graphsonVertex, len(vertices))
+	for _, v := range vertices {
+		gv := &graphsonVertex{
+			ID:         v.ID(),
+			Label:      v.Label,
+			Properties: make(map[string][]graphsonVertexProperty),
+		}
+		for _, p := range v.allProperties() {
+			values := []interface{}{p.Value}
+			if l, ok := p.Value.([]string); ok {
+				values = make([]interface{}, len(l))
+				for i, s := range l {
+					values[i] = s
+				}
+			}
+			for i, val := range values {
+				gv.Properties[p.Key] = append(gv.Properties[p.Key], graphsonVertexProperty{
+					ID:    fmt.Sprintf("%s/%s/%d", gv.ID, p.Key, i),
+					Value: graphsonValue(val),
+				})
+			}
+		}
+		out[gv.ID] = gv
+	}
+	for _, e := range g.sortedEdges() {
+		props := make(map[string]interface{})
+		for _, p := range e.Properties {
+			props[p.Key] = graphsonValue(p.Value)
+		}
+		from, to := out[e.From.ID()], out[e.To.ID()]
+		if from.OutE == nil {
+			from.OutE = make(map[string][]graphsonEdge)
+		}
+		if to.InE == nil {
+			to.InE = make(map[string][]graphsonEdge)
+		}
+		from.OutE[e.Label] = append(from.OutE[e.Label], graphsonEdge{ID: e.ID(), InV: to.ID, Properties: props})
+		to.InE[e.Label] = append(to.InE[e.Label], graphsonEdge{ID: e.ID(), OutV: from.ID, Properties: props})
+	}
+
+	f, err := os.Create(s.path)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, v := range vertices {
+		if err := enc.Encode(out[v.ID()]); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// graphsonValue adds the GraphSON 3.0 type for values that are not plain JSON
+// strings or booleans.
+func graphsonValue(v interface{}) interface{} {
+	switch t := v.(type) {
+	case int:
+		return map[string]interface{}{"@type": "g:Int32", "@value": t}
+	case int64:
+		return map[string]interface{}{"@type": "g:Int64", "@value": t}
+	case string, bool:
+		return t
+	}
+	return fmt.Sprint(v)
+}
@@ -0,0 +1,291 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/golang/glog"
+	"golang.org/x/net/websocket"
+)
+
+// Gremlin Server WebSocket protocol, see
+// http://tinkerpop.apache.org/docs/current/dev/provider/#_graph_driver_provider_requirements
+// Requests are sent as binary frames prefixed with the serializer mime type,
+// responses come back as GraphSON 3.0 and may be split across several frames (206).
+const (
+	gremlinMimeType = "application/vnd.gremlin-v3.0+json"
+
+	gremlinStatusSuccess        = 200
+	gremlinStatusNoContent      = 204
+	gremlinStatusPartialContent = 206
+	gremlinStatusAuthenticate   = 407
+)
+
+type gremlinUUID string
+
+func (u gremlinUUID) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]string{
+		"@type":  "g:UUID",
+		"@value": string(u),
+	})
+}
+
+type gremlinRequest struct {
+	RequestID gremlinUUID            `json:"requestId"`
+	Op        string                 `json:"op"`
+	Processor string                 `json:"processor"`
+	Args      map[string]interface{} `json:"args"`
+}
+
+type gremlinResponse struct {
+	RequestID string `json:"requestId"`
+	Status    struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"status"`
+	Result struct {
+		Data json.RawMessage `json:"data"`
+	} `json:"result"`
+}
+
+// gremlinSink submits the groovy mutations directly to a Gremlin Server instead of
+// writing them to files.  Mutations are grouped into batches and each
+// batch is evaluated as one script inside a single session; every mutation runs in
+// its own closure that receives that mutation's parameters from the 'params' binding.
+// The server is only connected to when the first batch is sent, after the crawl, so
+// that the connection isn't left idle (and dropped by a proxy) while it runs.
+type gremlinSink struct {
+	config    *websocket.Config
+	username  string
+	password  string
+	batchSize int
+
+	mu      sync.Mutex
+	ws      *websocket.Conn
+	session gremlinUUID
+	pending []statement
+	batches int
+	failed  int
+}
+
+func newGremlinSink(url, username, password string, batchSize int) (*gremlinSink, error) {
+	if batchSize < 1 {
+		batchSize = 1
+	}
+	config, err := websocket.NewConfig(url, "http://localhost/")
+	if err != nil {
+		return nil, err
+	}
+	return &gremlinSink{
+		config:    config,
+		username:  username,
+		password:  password,
+		batchSize: batchSize,
+		session:   newUUID(),
+	}, nil
+}
+
+func (c *gremlinSink) WriteGraph(g *graph) error {
+	return streamGraph(c, g)
+}
+
+func (c *gremlinSink) UpsertVertex(v *Vertex) error {
+	m := newMutation(true)
+	m.upsertVertex(v)
+	return c.submit(m.statement())
+}
+
+func (c *gremlinSink) UpsertEdge(e *Edge) error {
+	m := newMutation(true)
+	m.upsertEdge(e)
+	return c.submit(m.statement())
+}
+
+func (c *gremlinSink) UpdateVertex(old, v *Vertex) error {
+	m := newMutation(true)
+	m.updateVertex(old, v)
+	return c.submit(m.statement())
+}
+
+func (c *gremlinSink) UpdateEdge(old, e *Edge) error {
+	m := newMutation(true)
+	m.updateEdge(old, e)
+	return c.submit(m.statement())
+}
+
+func (c *gremlinSink) DropVertex(v *Vertex) error {
+	m := newMutation(true)
+	m.dropVertex(v)
+	return c.submit(m.statement())
+}
+
+func (c *gremlinSink) DropEdge(e *Edge) error {
+	m := newMutation(true)
+	m.dropEdge(e)
+	return c.submit(m.statement())
+}
+
+// submit queues a mutation and sends the batch once it is full.
+func (c *gremlinSink) submit(st statement) error {
+	glog.V(10).Infoln(st.script)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pending = append(c.pending, st)
+	if len(c.pending) < c.batchSize {
+		return nil
+	}
+	return c.flushLocked()
+}
+
+func (c *gremlinSink) Flush() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.flushLocked()
+}
+
+func (c *gremlinSink) flushLocked() error {
+	if len(c.pending) == 0 {
+		return nil
+	}
+	c.batches++
+	n := len(c.pending)
+	var script strings.Builder
+	params := make([]map[string]interface{}, n)
+	for i, st := range c.pending {
+		fmt.Fprintf(&script, "{ p ->%s}.call(params[%d])\n", st.script, i)
+		params[i] = st.params
+	}
+	c.pending = nil
+
+	_, err := c.do("eval", map[string]interface{}{
+		"gremlin":  script.String(),
+		"bindings": map[string]interface{}{"params": params},
+		"language": "gremlin-groovy",
+	})
+	if err != nil {
+		c.failed++
+		return fmt.Errorf("gremlin batch %d (%d mutations) failed: %v", c.batches, n, err)
+	}
+	glog.V(4).Infof("            Gremlin batch %d applied (%d mutations)", c.batches, n)
+	return nil
+}
+
+// Close flushes anything pending, closes the server side session and the connection.
+func (c *gremlinSink) Close() error {
+	ferr := c.Flush()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.ws == nil {
+		// nothing was sent
+		return ferr
+	}
+	if _, err := c.do("close", map[string]interface{}{}); err != nil {
+		glog.Errorf("Unable to close gremlin session %s: %v", c.session, err)
+	}
+	glog.V(2).Infof("Gremlin: %d batches submitted, %d failed", c.batches, c.failed)
+	if err := c.ws.Close(); err != nil && ferr == nil {
+		ferr = err
+	}
+	return ferr
+}
+
+// do sends one request within the session and collects the result data of every
+// response frame.  If the server asks for credentials, a SASL PLAIN response is
+// sent for the same request id.
+func (c *gremlinSink) do(op string, args map[string]interface{}) ([]json.RawMessage, error) {
+	if c.ws == nil {
+		ws, err := websocket.DialConfig(c.config)
+		if err != nil {
+			return nil, fmt.Errorf("unable to connect to gremlin server %s: %v", c.config.Location, err)
+		}
+		c.ws = ws
+	}
+	args["session"] = string(c.session)
+	req := &gremlinRequest{
+		RequestID: newUUID(),
+		Op:        op,
+		Processor: "session",
+		Args:      args,
+	}
+	if err := c.send(req); err != nil {
+		return nil, err
+	}
+
+	var data []json.RawMessage
+	for {
+		var msg []byte
+		if err := websocket.Message.Receive(c.ws, &msg); err != nil {
+			return nil, err
+		}
+		resp := &gremlinResponse{}
+		if err := json.Unmarshal(msg, resp); err != nil {
+			return nil, fmt.Errorf("unable to parse gremlin response: %v", err)
+		}
+		if resp.RequestID != string(req.RequestID) {
+			glog.V(10).Infof("Ignoring gremlin response for request %s", resp.RequestID)
+			continue
+		}
+		switch resp.Status.Code {
+		case gremlinStatusSuccess, gremlinStatusNoContent:
+			return append(data, resp.Result.Data), nil
+		case gremlinStatusPartialContent:
+			data = append(data, resp.Result.Data)
+		case gremlinStatusAuthenticate:
+			if c.username == "" {
+				return nil, fmt.Errorf("gremlin server requires authentication, set --gremlinUsername and --gremlinPassword")
+			}
+			sasl := base64.StdEncoding.EncodeToString([]byte("\x00" + c.username + "\x00" + c.password))
+			if err := c.send(&gremlinRequest{
+				RequestID: req.RequestID,
+				Op:        "authentication",
+				Args: map[string]interface{}{
+					"sasl":          sasl,
+					"saslMechanism": "PLAIN",
+				},
+			}); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("status %d: %s", resp.Status.Code, resp.Status.Message)
+		}
+	}
+}
+
+func (c *gremlinSink) send(req *gremlinRequest) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	frame := append([]byte{byte(len(gremlinMimeType))}, gremlinMimeType...)
+	frame = append(frame, body...)
+	return websocket.Message.Send(c.ws, frame)
+}
+
+func newUUID() gremlinUUID {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		glog.Fatal(err)
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return gremlinUUID(fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]))
+}
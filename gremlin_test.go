@@ -0,0 +1,298 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.org/x/net/websocket"
+)
+
+// fakeRequest is a request as the fake Gremlin Server decodes it.
+type fakeRequest struct {
+	RequestID struct {
+		Value string `json:"@value"`
+	} `json:"requestId"`
+	Op        string                 `json:"op"`
+	Processor string                 `json:"processor"`
+	Args      map[string]interface{} `json:"args"`
+}
+
+type fakeResponse struct {
+	Code int
+	Data interface{}
+}
+
+// fakeGremlinServer answers each request with the responses of handle and records
+// every connection and request it receives.
+type fakeGremlinServer struct {
+	*httptest.Server
+	handle func(n int, req *fakeRequest) []fakeResponse
+
+	mu          sync.Mutex
+	connections int
+	requests    []*fakeRequest
+}
+
+func newFakeGremlinServer(t *testing.T, handle func(n int, req *fakeRequest) []fakeResponse) *fakeGremlinServer {
+	s := &fakeGremlinServer{handle: handle}
+	s.Server = httptest.NewServer(websocket.Handler(func(ws *websocket.Conn) {
+		s.mu.Lock()
+		s.connections++
+		s.mu.Unlock()
+		for {
+			var frame []byte
+			if err := websocket.Message.Receive(ws, &frame); err != nil {
+				return
+			}
+			if len(frame) == 0 || int(frame[0]) >= len(frame) || string(frame[1:1+frame[0]]) != gremlinMimeType {
+				t.Errorf("request frame is not prefixed with %s: %q", gremlinMimeType, frame)
+				return
+			}
+			req := &fakeRequest{}
+			if err := json.Unmarshal(frame[1+frame[0]:], req); err != nil {
+				t.Errorf("unable to parse request: %v", err)
+				return
+			}
+			s.mu.Lock()
+			s.requests = append(s.requests, req)
+			n := len(s.requests) - 1
+			s.mu.Unlock()
+
+			for _, r := range s.handle(n, req) {
+				body, _ := json.Marshal(map[string]interface{}{
+					"requestId": req.RequestID.Value,
+					"status":    map[string]interface{}{"code": r.Code, "message": fmt.Sprintf("status %d", r.Code)},
+					"result":    map[string]interface{}{"data": r.Data},
+				})
+				if err := websocket.Message.Send(ws, string(body)); err != nil {
+					return
+				}
+			}
+		}
+	}))
+	return s
+}
+
+func (s *fakeGremlinServer) sink(t *testing.T, username, password string, batchSize int) *gremlinSink {
+	c, err := newGremlinSink("ws"+strings.TrimPrefix(s.URL, "http"), username, password, batchSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// received returns the requests received so far.
+func (s *fakeGremlinServer) received() []*fakeRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*fakeRequest{}, s.requests...)
+}
+
+// evals returns the eval requests received so far.
+func (s *fakeGremlinServer) evals() []*fakeRequest {
+	var evals []*fakeRequest
+	for _, r := range s.received() {
+		if r.Op == "eval" {
+			evals = append(evals, r)
+		}
+	}
+	return evals
+}
+
+func (s *fakeGremlinServer) connected() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.connections
+}
+
+func respondOK(n int, req *fakeRequest) []fakeResponse {
+	return []fakeResponse{{Code: gremlinStatusSuccess, Data: []interface{}{}}}
+}
+
+func TestGremlinBatchSize(t *testing.T) {
+	s := newFakeGremlinServer(t, respondOK)
+	defer s.Close()
+	c := s.sink(t, "", "", 3)
+
+	for i := 0; i < 7; i++ {
+		if err := c.UpsertVertex(userVertex(fmt.Sprintf("user%d@example.com", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := len(s.evals()); got != 2 {
+		t.Errorf("%d batches submitted before Close, want 2", got)
+	}
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	evals := s.evals()
+	want := []int{3, 3, 1}
+	if len(evals) != len(want) {
+		t.Fatalf("%d batches submitted, want %d", len(evals), len(want))
+	}
+	for i, r := range evals {
+		params, _ := r.Args["bindings"].(map[string]interface{})["params"].([]interface{})
+		script, _ := r.Args["gremlin"].(string)
+		if len(params) != want[i] || strings.Count(script, "{ p ->") != want[i] {
+			t.Errorf("batch %d has %d params and %d closures, want %d", i, len(params), strings.Count(script, "{ p ->"), want[i])
+		}
+		if r.Processor != "session" || r.Args["session"] != string(c.session) {
+			t.Errorf("batch %d was not submitted in session %s: %v %v", i, c.session, r.Processor, r.Args["session"])
+		}
+	}
+	all := s.received()
+	if last := all[len(all)-1]; last.Op != "close" {
+		t.Errorf("last request is %q, want the session to be closed", last.Op)
+	}
+}
+
+// The sink only connects to send its first batch, not while the crawl runs.
+func TestGremlinConnectsOnFirstBatch(t *testing.T) {
+	s := newFakeGremlinServer(t, respondOK)
+	defer s.Close()
+
+	idle := s.sink(t, "", "", 2)
+	if err := idle.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if s.connected() != 0 || len(s.received()) != 0 {
+		t.Errorf("a sink that sent nothing made %d connections and %d requests", s.connected(), len(s.received()))
+	}
+
+	c := s.sink(t, "", "", 2)
+	if err := c.UpsertVertex(userVertex("user@example.com")); err != nil {
+		t.Fatal(err)
+	}
+	if s.connected() != 0 {
+		t.Errorf("connected before the first batch was sent")
+	}
+	if err := c.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.UpsertVertex(userVertex("other@example.com")); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if s.connected() != 1 || len(s.evals()) != 2 {
+		t.Errorf("%d connections for %d batches, want 1 for 2", s.connected(), len(s.evals()))
+	}
+}
+
+func TestGremlinPartialContent(t *testing.T) {
+	s := newFakeGremlinServer(t, func(n int, req *fakeRequest) []fakeResponse {
+		return []fakeResponse{
+			{Code: gremlinStatusPartialContent, Data: []int{1}},
+			{Code: gremlinStatusPartialContent, Data: []int{2}},
+			{Code: gremlinStatusSuccess, Data: []int{3}},
+		}
+	})
+	defer s.Close()
+	c := s.sink(t, "", "", 1)
+	defer func() { c.ws.Close() }()
+
+	data, err := c.do("eval", map[string]interface{}{"gremlin": "g.V().count()"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, d := range data {
+		got = append(got, string(d))
+	}
+	if strings.Join(got, ",") != "[1],[2],[3]" {
+		t.Errorf("got result data %v, want the data of all 3 frames", got)
+	}
+}
+
+func TestGremlinAuthentication(t *testing.T) {
+	s := newFakeGremlinServer(t, func(n int, req *fakeRequest) []fakeResponse {
+		if req.Op == "eval" {
+			return []fakeResponse{{Code: gremlinStatusAuthenticate}}
+		}
+		return respondOK(n, req)
+	})
+	defer s.Close()
+	c := s.sink(t, "admin", "s3cret", 1)
+	defer func() { c.ws.Close() }()
+
+	if err := c.UpsertVertex(userVertex("user1@example.com")); err != nil {
+		t.Fatal(err)
+	}
+	all := s.received()
+	if len(all) != 2 {
+		t.Fatalf("%d requests sent, want the eval and its authentication", len(all))
+	}
+	eval, auth := all[0], all[1]
+	if auth.Op != "authentication" || auth.RequestID.Value != eval.RequestID.Value {
+		t.Errorf("got %q request %s, want an authentication for request %s", auth.Op, auth.RequestID.Value, eval.RequestID.Value)
+	}
+	if auth.Args["saslMechanism"] != "PLAIN" {
+		t.Errorf("saslMechanism is %v, want PLAIN", auth.Args["saslMechanism"])
+	}
+	sasl, err := base64.StdEncoding.DecodeString(fmt.Sprint(auth.Args["sasl"]))
+	if err != nil || string(sasl) != "\x00admin\x00s3cret" {
+		t.Errorf("sasl is %q (%v), want \\x00admin\\x00s3cret", sasl, err)
+	}
+}
+
+func TestGremlinAuthenticationWithoutCredentials(t *testing.T) {
+	s := newFakeGremlinServer(t, func(n int, req *fakeRequest) []fakeResponse {
+		return []fakeResponse{{Code: gremlinStatusAuthenticate}}
+	})
+	defer s.Close()
+	c := s.sink(t, "", "", 1)
+	defer func() { c.ws.Close() }()
+
+	err := c.UpsertVertex(userVertex("user1@example.com"))
+	if err == nil || !strings.Contains(err.Error(), "--gremlinUsername") {
+		t.Errorf("got %v, want an error asking for credentials", err)
+	}
+}
+
+func TestGremlinFailedBatch(t *testing.T) {
+	s := newFakeGremlinServer(t, func(n int, req *fakeRequest) []fakeResponse {
+		if n == 1 {
+			return []fakeResponse{{Code: 597}}
+		}
+		return respondOK(n, req)
+	})
+	defer s.Close()
+	c := s.sink(t, "", "", 2)
+
+	var errs []error
+	for i := 0; i < 6; i++ {
+		if err := c.UpsertVertex(userVertex(fmt.Sprintf("user%d@example.com", i))); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), "batch 2") || !strings.Contains(errs[0].Error(), "597") {
+		t.Errorf("got errors %v, want batch 2 to fail with status 597", errs)
+	}
+	if c.batches != 3 || c.failed != 1 {
+		t.Errorf("%d batches, %d failed, want 3 and 1", c.batches, c.failed)
+	}
+}
@@ -0,0 +1,168 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"os"
+	"sync"
+
+	"github.com/golang/glog"
+)
+
+const (
+	projectsConfig       = "projects.groovy"
+	usersConfig          = "users.groovy"
+	iamConfig            = "iam.groovy"
+	serviceAccountConfig = "serviceaccounts.groovy"
+	rolesConfig          = "roles.groovy"
+	groupsConfig         = "groups.groovy"
+	gcsConfig            = "gcs.groovy"
+)
+
+// groovySink writes the mutations to the .groovy files that get :load'ed into the
+// gremlin console.  Each file is created the first time something is written to it.
+type groovySink struct {
+	mu    sync.Mutex
+	files map[string]*groovyFile
+}
+
+type groovyFile struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+func newGroovySink() *groovySink {
+	return &groovySink{files: make(map[string]*groovyFile)}
+}
+
+func vertexConfig(label string) string {
+	switch label {
+	case "user":
+		return usersConfig
+	case "group", "customer", "domain":
+		return groupsConfig
+	case "serviceAccount":
+		return serviceAccountConfig
+	case "project", "folder", "organization":
+		return projectsConfig
+	case "role", "permission":
+		return rolesConfig
+	case "bucket":
+		return gcsConfig
+	}
+	return iamConfig
+}
+
+func edgeConfig(e *Edge) string {
+	switch {
+	case e.To.Label == "group":
+		return groupsConfig
+	case e.From.Label == "bucket" || e.To.Label == "bucket":
+		return gcsConfig
+	case e.From.Label == "permission":
+		return rolesConfig
+	}
+	return iamConfig
+}
+
+func (s *groovySink) WriteGraph(g *graph) error {
+	return streamGraph(s, g)
+}
+
+func (s *groovySink) UpsertVertex(v *Vertex) error {
+	m := newMutation(false)
+	m.upsertVertex(v)
+	return s.write(vertexConfig(v.Label), m.statement().script)
+}
+
+func (s *groovySink) UpsertEdge(e *Edge) error {
+	m := newMutation(false)
+	m.upsertEdge(e)
+	return s.write(edgeConfig(e), m.statement().script)
+}
+
+func (s *groovySink) UpdateVertex(old, v *Vertex) error {
+	m := newMutation(false)
+	m.updateVertex(old, v)
+	return s.write(vertexConfig(v.Label), m.statement().script)
+}
+
+func (s *groovySink) UpdateEdge(old, e *Edge) error {
+	m := newMutation(false)
+	m.updateEdge(old, e)
+	return s.write(edgeConfig(e), m.statement().script)
+}
+
+func (s *groovySink) DropVertex(v *Vertex) error {
+	m := newMutation(false)
+	m.dropVertex(v)
+	return s.write(vertexConfig(v.Label), m.statement().script)
+}
+
+func (s *groovySink) DropEdge(e *Edge) error {
+	m := newMutation(false)
+	m.dropEdge(e)
+	return s.write(edgeConfig(e), m.statement().script)
+}
+
+func (s *groovySink) write(srcFile string, cmd string) error {
+	s.mu.Lock()
+	gf, ok := s.files[srcFile]
+	if !ok {
+		f, err := os.Create(srcFile)
+		if err != nil {
+			s.mu.Unlock()
+			return err
+		}
+		gf = &groovyFile{f: f}
+		s.files[srcFile] = gf
+	}
+	s.mu.Unlock()
+
+	glog.V(10).Infoln(cmd)
+	gf.mu.Lock()
+	defer gf.mu.Unlock()
+	_, err := gf.f.WriteString(cmd)
+	return err
+}
+
+func (s *groovySink) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, gf := range s.files {
+		gf.mu.Lock()
+		err := gf.f.Sync()
+		gf.mu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *groovySink) Close() error {
+	if err := s.Flush(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for name, gf := range s.files {
+		if err := gf.f.Close(); err != nil {
+			return err
+		}
+		delete(s.files, name)
+	}
+	return nil
+}
@@ -0,0 +1,196 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/context"
+)
+
+// listGroups lists the customer's groups one page at a time with listPage (which adds
+// the page's groups to the graph and returns their keys and the next page token) and
+// expands the members of every group listed with expand.  The listing resumes at the
+// page saved under unit; previous are the groups a resumed crawl listed before, whose
+// members may not be loaded yet.
+func listGroups(ctx context.Context, unit string, previous []string,
+	listPage func(pageToken string) ([]string, string, error),
+	expand func(ctx context.Context, groupKey string) []string) {
+	x := newGroupExpander(expand)
+	for _, g := range previous {
+		x.enqueue(g)
+	}
+
+	_, listed := state.isDone(unit)
+	pageToken := state.pageToken(unit)
+	for !listed {
+		groups, next, err := listPage(pageToken)
+		if err != nil {
+			// still expand the groups listed so far
+			addError("groups", "customers/"+*cx, err)
+			break
+		}
+		for _, g := range groups {
+			x.enqueue(g)
+		}
+		pageToken = next
+		if pageToken == "" {
+			state.markDone(unit)
+			break
+		}
+		state.setPageToken(unit, pageToken)
+	}
+
+	x.run(ctx, *groupWorkers)
+}
+
+// groupExpander fetches the membership of every group exactly once with a fixed
+// number of workers.  Nested groups found while expanding are queued unless they
+// were seen before, so a cycle (a contains b contains a) terminates.
+type groupExpander struct {
+	expand func(ctx context.Context, groupKey string) []string
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	seen    map[string]bool
+	queue   []string
+	pending int
+	// nested records group -> member groups to report cycles once done
+	nested map[string][]string
+}
+
+// newGroupExpander uses expand to load one group's members and return its nested groups.
+func newGroupExpander(expand func(ctx context.Context, groupKey string) []string) *groupExpander {
+	x := &groupExpander{
+		expand: expand,
+		seen:   make(map[string]bool),
+		nested: make(map[string][]string),
+	}
+	x.cond = sync.NewCond(&x.mu)
+	return x
+}
+
+// enqueue schedules a group for expansion if it hasn't been already.
+func (x *groupExpander) enqueue(groupKey string) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if x.seen[groupKey] {
+		return
+	}
+	x.seen[groupKey] = true
+	x.queue = append(x.queue, groupKey)
+	x.pending++
+	x.cond.Signal()
+}
+
+// run expands the queued groups (and everything nested in them) and returns when
+// there is nothing left to do.
+func (x *groupExpander) run(ctx context.Context, workers int) {
+	if workers < 1 {
+		workers = 1
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				groupKey, ok := x.next()
+				if !ok {
+					return
+				}
+				nested := x.expand(ctx, groupKey)
+				x.mu.Lock()
+				x.nested[groupKey] = nested
+				x.mu.Unlock()
+				for _, n := range nested {
+					x.enqueue(n)
+				}
+				x.done()
+			}
+		}()
+	}
+	wg.Wait()
+	x.reportCycles()
+}
+
+func (x *groupExpander) next() (string, bool) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	for len(x.queue) == 0 && x.pending > 0 {
+		x.cond.Wait()
+	}
+	if len(x.queue) == 0 {
+		return "", false
+	}
+	groupKey := x.queue[0]
+	x.queue = x.queue[1:]
+	return groupKey, true
+}
+
+func (x *groupExpander) done() {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.pending--
+	if x.pending == 0 {
+		x.cond.Broadcast()
+	}
+}
+
+// reportCycles walks the nested group graph and adds a finding for every cycle.
+func (x *groupExpander) reportCycles() {
+	const (
+		unvisited = iota
+		onStack
+		finished
+	)
+	mark := make(map[string]int)
+	var stack []string
+	var visit func(string)
+	visit = func(g string) {
+		mark[g] = onStack
+		stack = append(stack, g)
+		for _, n := range x.nested[g] {
+			switch mark[n] {
+			case unvisited:
+				visit(n)
+			case onStack:
+				var cycle []string
+				for i := len(stack) - 1; i >= 0; i-- {
+					if stack[i] == n {
+						cycle = append(append(cycle, stack[i:]...), n)
+						break
+					}
+				}
+				addFinding("groupCycle", "nested groups form a cycle: "+strings.Join(cycle, " -> "), cycle...)
+			}
+		}
+		stack = stack[:len(stack)-1]
+		mark[g] = finished
+	}
+
+	groups := make([]string, 0, len(x.nested))
+	for g := range x.nested {
+		groups = append(groups, g)
+	}
+	sort.Strings(groups)
+	for _, g := range groups {
+		if mark[g] == unvisited {
+			visit(g)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// expandGroups runs a groupExpander over the nested groups, starting with roots, and
+// returns how many times each group was fetched and the findings it reported.
+func expandGroups(t *testing.T, nested map[string][]string, workers int, roots ...string) (map[string]int, []Finding) {
+	defer func(f []Finding) { findings = f }(findings)
+	findings = nil
+
+	var mu sync.Mutex
+	fetched := make(map[string]int)
+	x := newGroupExpander(func(ctx context.Context, groupKey string) []string {
+		mu.Lock()
+		fetched[groupKey]++
+		mu.Unlock()
+		// let the other workers run while this one "fetches"
+		time.Sleep(time.Millisecond)
+		return nested[groupKey]
+	})
+	for _, r := range roots {
+		x.enqueue(r)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		x.run(context.Background(), workers)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("the group expander did not finish")
+	}
+	return fetched, findings
+}
+
+func TestGroupExpanderCycles(t *testing.T) {
+	nested := map[string][]string{
+		"a":    {"b"},
+		"b":    {"c"},
+		"c":    {"a"},
+		"self": {"self"},
+		"d":    {"b", "e"},
+		"e":    nil,
+	}
+	for _, workers := range []int{1, 4, 16} {
+		fetched, found := expandGroups(t, nested, workers, "a", "self", "d", "a")
+		want := map[string]int{"a": 1, "b": 1, "c": 1, "self": 1, "d": 1, "e": 1}
+		if !reflect.DeepEqual(fetched, want) {
+			t.Errorf("%d workers fetched %v, want every group once", workers, fetched)
+		}
+		var cycles [][]string
+		for _, f := range found {
+			if f.Kind != "groupCycle" {
+				t.Errorf("unexpected finding %v", f)
+			}
+			cycles = append(cycles, f.Subjects)
+		}
+		if want := [][]string{{"a", "b", "c", "a"}, {"self", "self"}}; !reflect.DeepEqual(cycles, want) {
+			t.Errorf("%d workers found cycles %v, want %v", workers, cycles, want)
+		}
+	}
+}
+
+// Every group is listed and also nested in several others.
+func TestGroupExpanderShared(t *testing.T) {
+	nested := make(map[string][]string)
+	var groups []string
+	for i := 0; i < 200; i++ {
+		g := fmt.Sprintf("g%d", i)
+		groups = append(groups, g)
+		for j := 1; j <= 3; j++ {
+			nested[g] = append(nested[g], fmt.Sprintf("g%d", (i*7+j)%200))
+		}
+	}
+	fetched, _ := expandGroups(t, nested, 8, groups...)
+	var twice []string
+	for g, n := range fetched {
+		if n != 1 {
+			twice = append(twice, g)
+		}
+	}
+	sort.Strings(twice)
+	if len(twice) > 0 {
+		t.Errorf("fetched more than once: %v", twice)
+	}
+	if len(fetched) != len(nested) {
+		t.Errorf("fetched %d of %d groups", len(fetched), len(nested))
+	}
+}
+
+func TestGroupExpanderNothingQueued(t *testing.T) {
+	fetched, found := expandGroups(t, nil, 4)
+	if len(fetched) != 0 || len(found) != 0 {
+		t.Errorf("fetched %v and found %v with nothing queued", fetched, found)
+	}
+}
+
+func TestWriteNoFindings(t *testing.T) {
+	defer func(f []Finding) { findings = f }(findings)
+	findings = nil
+	path := filepath.Join(t.TempDir(), "findings.json")
+	if err := writeFindings(path); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "[]" {
+		t.Errorf("no findings are written as %s, want []", data)
+	}
+}
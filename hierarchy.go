@@ -0,0 +1,169 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+	"google.golang.org/api/cloudresourcemanager/v1"
+	crmv2 "google.golang.org/api/cloudresourcemanager/v2"
+)
+
+var (
+	foldersService *crmv2.FoldersService
+
+	// every ACTIVE folder under the organization, parents before children
+	folders = make([]*crmv2.Folder, 0)
+)
+
+func organizationVertex(name string) *Vertex {
+	return newVertex("organization", "name", name)
+}
+
+func folderVertex(name string) *Vertex {
+	return newVertex("folder", "name", name)
+}
+
+// resourceVertex maps a resource manager parent (organizations/123 or folders/456)
+// to its vertex.
+func resourceVertex(name string) *Vertex {
+	if strings.HasPrefix(name, "folders/") {
+		return folderVertex(name)
+	}
+	return organizationVertex(name)
+}
+
+// projectParent returns the resource name of the folder or organization a project is in.
+func projectParent(p *cloudresourcemanager.Project) string {
+	if p.Parent == nil {
+		return ""
+	}
+	return p.Parent.Type + "s/" + p.Parent.Id
+}
+
+// getProjects starts at the organization and walks its folders recursively; only the
+// ACTIVE projects directly under the organization or one of its folders are kept.
+func getProjects(ctx context.Context) {
+	glog.V(2).Infof(">>>>>>>>>>> Getting Projects")
+	org := fmt.Sprintf("organizations/%s", *organization)
+	if err := getProjectsIn(ctx, org); err != nil {
+		addError("projects", org, err)
+	}
+	getFolders(ctx, org)
+}
+
+// getFolders adds the folders under parent and their projects, recursively.  A
+// folder that can't be listed is reported and skipped.
+func getFolders(ctx context.Context, parent string) {
+	var children []*crmv2.Folder
+	if err := foldersService.List().Parent(parent).Pages(ctx, func(page *crmv2.ListFoldersResponse) error {
+		for _, f := range page.Folders {
+			if f.LifecycleState == "ACTIVE" {
+				glog.V(4).Infof("            Adding Folder %v (%v) in %v", f.Name, f.DisplayName, parent)
+				children = append(children, f)
+			}
+		}
+		return nil
+	}); err != nil {
+		addError("projects", parent, err)
+		return
+	}
+	folders = append(folders, children...)
+	for _, f := range children {
+		if err := getProjectsIn(ctx, f.Name); err != nil {
+			addError("projects", f.Name, err)
+		}
+		getFolders(ctx, f.Name)
+	}
+}
+
+// getProjectsIn lists the projects whose direct parent is the given folder or organization.
+func getProjectsIn(ctx context.Context, parent string) error {
+	parts := strings.SplitN(parent, "/", 2)
+	filter := fmt.Sprintf("parent.type:%s parent.id:%s", strings.TrimSuffix(parts[0], "s"), parts[1])
+	return crmService.Projects.List().Filter(filter).Pages(ctx, func(page *cloudresourcemanager.ListProjectsResponse) error {
+		for _, p := range page.Projects {
+			if p.LifecycleState == "ACTIVE" {
+				projects = append(projects, p)
+			}
+		}
+		return nil
+	})
+}
+
+// getHierarchy adds the organization, its folders and the projects in them with
+// folder -in-> parent and project -in-> parent edges.
+func getHierarchy() {
+	upsertVertex(organizationVertex(fmt.Sprintf("organizations/%s", *organization)))
+	for _, f := range folders {
+		upsertVertex(folderVertex(f.Name).set("displayName", f.DisplayName))
+		upsertEdge(inEdge(folderVertex(f.Name), resourceVertex(f.Parent)))
+	}
+	for _, p := range projects {
+		if parent := projectParent(p); parent != "" {
+			upsertEdge(inEdge(projectVertex(p.ProjectId), resourceVertex(parent)))
+		}
+	}
+}
+
+func getOrganizationIamPolicy(ctx context.Context, org string) {
+	defer wg.Done()
+	glog.V(2).Infof(">>>>>>>>>>> Getting IAMPolicy for Organization %v", org)
+	if _, ok := state.isDone("IAM:" + org); ok {
+		return
+	}
+	rb := &cloudresourcemanager.GetIamPolicyRequest{
+		Options: &cloudresourcemanager.GetPolicyOptions{RequestedPolicyVersion: iamPolicyVersion},
+	}
+	resp, err := crmService.Organizations.GetIamPolicy(org, rb).Context(ctx).Do()
+	if err != nil {
+		addError("IAM", org, err)
+		return
+	}
+	addBindings(organizationVertex(org), resp.Bindings)
+	state.markDone("IAM:" + org)
+}
+
+func getFolderIamPolicy(ctx context.Context, folder string) {
+	defer wg.Done()
+	glog.V(2).Infof(">>>>>>>>>>> Getting IAMPolicy for Folder %v", folder)
+	if _, ok := state.isDone("IAM:" + folder); ok {
+		return
+	}
+	rb := &crmv2.GetIamPolicyRequest{
+		Options: &crmv2.GetPolicyOptions{RequestedPolicyVersion: iamPolicyVersion},
+	}
+	resp, err := foldersService.GetIamPolicy(folder, rb).Context(ctx).Do()
+	if err != nil {
+		addError("IAM", folder, err)
+		return
+	}
+	bindings := make([]*cloudresourcemanager.Binding, len(resp.Bindings))
+	for i, b := range resp.Bindings {
+		bindings[i] = &cloudresourcemanager.Binding{Role: b.Role, Members: b.Members}
+		if b.Condition != nil {
+			bindings[i].Condition = &cloudresourcemanager.Expr{
+				Title:       b.Condition.Title,
+				Expression:  b.Condition.Expression,
+				Description: b.Condition.Description,
+			}
+		}
+	}
+	addBindings(folderVertex(folder), bindings)
+	state.markDone("IAM:" + folder)
+}
@@ -21,176 +21,117 @@ NOTE: this product is NOT supported by Google and has not been tested at scale.
 */
 
 import (
+	"crypto/sha256"
 	"flag"
 	"fmt"
 	"io/ioutil"
+	"net/http"
 	"os"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"cloud.google.com/go/storage"
 	"github.com/golang/glog"
 	"golang.org/x/net/context"
-	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
-	"golang.org/x/time/rate"
 	admin "google.golang.org/api/admin/directory/v1"
+	"google.golang.org/api/cloudidentity/v1"
 	"google.golang.org/api/cloudresourcemanager/v1"
+	crmv2 "google.golang.org/api/cloudresourcemanager/v2"
 	"google.golang.org/api/iam/v1"
 	"google.golang.org/api/iterator"
 	"google.golang.org/api/option"
 )
 
 var (
-	wg     sync.WaitGroup
-	wg2    sync.WaitGroup
-	cmutex = &sync.Mutex{}
+	wg sync.WaitGroup
 
-	component          = flag.String("component", "all", "component to load: choices, all|projectIAM|users|serviceaccounts|roles|groups")
+	component          = flag.String("component", "all", "component to load: choices, all|IAM|users|orgunits|groups|serviceaccounts|gcs")
 	serviceAccountFile = flag.String("serviceAccountFile", "svc_account.json", "Servie Account JSON file with IAM permissions to the org")
 	subject            = flag.String("subject", "admin@esodemoapp2.com", "Admin user to for the organization")
 	organization       = flag.String("organization", "", "OrganizationID")
 	cx                 = flag.String("cx", "", "Customer ID number for the Gsuites domain")
-	delay              = flag.Int("delay", 100, "delay in ms for each goroutine")
+	delay              = flag.Int("delay", 0, "deprecated and ignored: API calls are throttled by --adminQPS, --iamQPS, --crmQPS, --cloudIdentityQPS and --storageQPS")
 	includePermissions = flag.Bool("includePermissions", false, "Include Permissions in Graph")
-
-	adminService *admin.Service
-	iamService   *iam.Service
-	crmService   *cloudresourcemanager.Service
+	groupsAPI          = flag.String("groupsAPI", "directory", "API to load the groups with: choices, directory (Admin SDK)|cloudidentity (Cloud Identity Groups, with labels and dynamic groups)")
+	transitiveMembers  = flag.Bool("transitiveMembers", false, "also load the members of nested groups (--groupsAPI=cloudidentity, needs Cloud Identity Premium)")
+	groupWorkers       = flag.Int("groupWorkers", 4, "number of groups to fetch members for concurrently")
+	findingsFile       = flag.String("findingsFile", "", "write the findings (eg, group membership cycles) to this JSON file")
+	errorsFile         = flag.String("errorsFile", "", "write the resources that failed to load (and why) to this JSON file")
+	maxErrors          = flag.Int("maxErrors", 0, "exit with status 2 if more than this many resources failed to load; -1 to always exit 0")
+	sink               = flag.String("sink", "groovy", "comma separated list of outputs for the graph: choices, groovy|gremlin|graphml|graphson|cypher|neo4j")
+	gremlinURL         = flag.String("gremlinURL", "ws://localhost:8182/gremlin", "Gremlin Server WebSocket endpoint (--sink=gremlin)")
+	gremlinUsername    = flag.String("gremlinUsername", "", "Gremlin Server username (--sink=gremlin)")
+	gremlinPassword    = flag.String("gremlinPassword", "", "Gremlin Server password (--sink=gremlin)")
+	gremlinBatchSize   = flag.Int("gremlinBatchSize", 50, "number of mutations to submit per Gremlin Server request (--sink=gremlin)")
+	graphmlFile        = flag.String("graphmlFile", "graph.xml", "GraphML file to write (--sink=graphml)")
+	graphsonFile       = flag.String("graphsonFile", "graph.json", "GraphSON 3.0 file to write (--sink=graphson)")
+	cypherFile         = flag.String("cypherFile", "graph.cypher", "Cypher MERGE script to write (--sink=cypher)")
+	neo4jImportDir     = flag.String("neo4jImportDir", "neo4j-import", "directory for the neo4j-admin import CSV files (--sink=neo4j)")
+	adminQPS           = flag.Float64("adminQPS", 10, "maximum requests per second to the Admin SDK Directory API (0 for no limit)")
+	iamQPS             = flag.Float64("iamQPS", 4, "maximum requests per second to the IAM API (0 for no limit)")
+	crmQPS             = flag.Float64("crmQPS", 10, "maximum requests per second to the Cloud Resource Manager API (0 for no limit)")
+	cloudIdentityQPS   = flag.Float64("cloudIdentityQPS", 10, "maximum requests per second to the Cloud Identity API (0 for no limit)")
+	storageQPS         = flag.Float64("storageQPS", 10, "maximum requests per second to the Cloud Storage API (0 for no limit)")
+	maxRetries         = flag.Int("maxRetries", 5, "number of times an API call failing with 429, 5xx or a rate limit error is retried")
+	minBackoff         = flag.Duration("minBackoff", time.Second, "wait before the first retry; doubled (with jitter) on each retry")
+	maxBackoff         = flag.Duration("maxBackoff", 32*time.Second, "longest wait between retries, unless the server's Retry-After is longer")
+	stateFile          = flag.String("stateFile", "", "save the crawl's progress and graph to this file every --checkpointInterval")
+	checkpointInterval = flag.Duration("checkpointInterval", time.Minute, "how often to save --stateFile")
+	resume             = flag.Bool("resume", false, "continue the crawl saved in --stateFile, skipping what it already loaded")
+	snapshotFile       = flag.String("snapshotFile", "", "save the graph of every successful run to this file")
+	incremental        = flag.Bool("incremental", false, "only send what changed since the run saved in --snapshotFile to the sinks")
+
+	adminService      *admin.Service
+	domainService     *admin.Service
+	orgUnitService    *admin.Service
+	iamService        *iam.Service
+	crmService        *cloudresourcemanager.Service
+	storageHTTPClient *http.Client
 
 	projects = make([]*cloudresourcemanager.Project, 0)
 
-	permissions = &Permissions{}
-	roles       = &Roles{}
-
-	limiter *rate.Limiter
-	ors     *iam.RolesService
-
-	projectsConfig = "projects.groovy"
-	pmutex         = &sync.Mutex{}
-	pfile          *os.File
-
-	usersConfig = "users.groovy"
-	umutex      = &sync.Mutex{}
-	ufile       *os.File
-
-	iamConfig = "iam.groovy"
-	imutex    = &sync.Mutex{}
-	ifile     *os.File
-
-	serviceAccountConfig = "serviceaccounts.groovy"
-	smutex               = &sync.Mutex{}
-	sfile                *os.File
-
-	rolesConfig = "roles.groovy"
-	rmutex      = &sync.Mutex{}
-	rfile       *os.File
-
-	groupsConfig = "groups.groovy"
-	gmutex       = &sync.Mutex{}
-	gfile        *os.File
-
-	gcsConfig = "gcs.groovy"
-	gcsmutex  = &sync.Mutex{}
-	gcsfile   *os.File
-)
+	ors *iam.RolesService
 
-const (
-	maxRequestsPerSecond float64 = 4 // "golang.org/x/time/rate" limiter to throttle operations
-	burst                int     = 4
+	output   Sink
+	orgGraph = newGraph()
 )
 
-type Roles struct {
-	Roles []Role `json:"roles"`
+// commands work on saved snapshots instead of crawling, eg. main diff old.json new.json
+var commands = map[string]func(args []string) error{
+	"diff":     runDiff,
+	"who-can":  runWhoCan,
+	"what-can": runWhatCan,
+	"explain":  runExplain,
+	"external": runExternal,
 }
 
-type Role struct {
-	Name                string   `json:"name"`
-	Role                iam.Role `json:"role"`
-	IncludedPermissions []string `json:"included_permissions"`
-}
+// IAM policy version that includes the bindings' conditions
+const iamPolicyVersion = 3
 
-type Permissions struct {
-	Permissions []Permission `json:"permissions"`
-}
-
-type Permission struct {
-	//Permission iam.Permission // there's no direct way to query a given permission detail!
-	Name  string   `json:"name"`
-	Roles []string `json:"roles"`
+func upsertVertex(v *Vertex) {
+	if _, err := orgGraph.upsertVertex(v); err != nil {
+		glog.Error(err)
+	}
 }
 
-func applyGroovy(cmd string, srcFile string) {
-
-	switch srcFile {
-	case projectsConfig:
-		pmutex.Lock()
-		_, err := pfile.WriteString(cmd)
-		err = pfile.Sync()
-		if err != nil {
-			glog.Fatal(err)
-		}
-		pmutex.Unlock()
-	case usersConfig:
-		umutex.Lock()
-		_, err := ufile.WriteString(cmd)
-		err = ufile.Sync()
-		if err != nil {
-			glog.Fatal(err)
-		}
-		umutex.Unlock()
-	case iamConfig:
-		imutex.Lock()
-		_, err := ifile.WriteString(cmd)
-		err = ifile.Sync()
-		if err != nil {
-			glog.Fatal(err)
-		}
-		imutex.Unlock()
-	case serviceAccountConfig:
-		smutex.Lock()
-		_, err := sfile.WriteString(cmd)
-		err = sfile.Sync()
-		if err != nil {
-			glog.Fatal(err)
-		}
-		smutex.Unlock()
-	case rolesConfig:
-		rmutex.Lock()
-		_, err := rfile.WriteString(cmd)
-		err = rfile.Sync()
-		if err != nil {
-			glog.Fatal(err)
-		}
-		rmutex.Unlock()
-	case groupsConfig:
-		gmutex.Lock()
-		_, err := gfile.WriteString(cmd)
-		err = gfile.Sync()
-		if err != nil {
-			glog.Fatal(err)
-		}
-		gmutex.Unlock()
-	case gcsConfig:
-		gcsmutex.Lock()
-		_, err := gcsfile.WriteString(cmd)
-		err = gcsfile.Sync()
-		if err != nil {
-			glog.Fatal(err)
-		}
-		gcsmutex.Unlock()
+func upsertEdge(e *Edge) {
+	if _, err := orgGraph.upsertEdge(e); err != nil {
+		glog.Error(err)
 	}
-
-	glog.V(10).Infoln(cmd)
-
 }
 
 func getUsers(ctx context.Context) {
 	defer wg.Done()
 	glog.V(2).Infoln(">>>>>>>>>>> Getting Users")
+	if _, ok := state.isDone("users"); ok {
+		glog.V(2).Infoln(">>>>>>>>>>> Users already loaded")
+		return
+	}
 
-	pageToken := ""
+	pageToken := state.pageToken("users")
 	for {
 		q := adminService.Users.List().Customer(*cx)
 		if pageToken != "" {
@@ -198,87 +139,98 @@ func getUsers(ctx context.Context) {
 		}
 		r, err := q.Do()
 		if err != nil {
-			glog.Fatal(err)
+			addError("users", "customers/"+*cx, err)
+			return
 		}
 		for _, u := range r.Users {
 			glog.V(4).Infoln("            Adding User: ", u.PrimaryEmail)
-			entry := `	
-if (g.V().hasLabel('user').has('email','%s').hasNext() == false) {
- g.addV('user').property(label, 'user').property('email', '%s').property('isExternal', false).id().next()
-}
-`
-			entry = fmt.Sprintf(entry, u.PrimaryEmail, u.PrimaryEmail)
-			applyGroovy(entry, usersConfig)
+			// the customer's own users and groups; everyone else is classified by domain
+			// once the crawl is done (see classifyPrincipals)
+			upsertVertex(directoryUserVertex(u).set("isExternal", false))
+			if u.OrgUnitPath != "" {
+				upsertEdge(inEdge(userVertex(u.PrimaryEmail), orgUnitVertex(u.OrgUnitPath)))
+			}
 		}
 		pageToken = r.NextPageToken
-		time.Sleep(time.Duration(*delay) * time.Millisecond)
 		if pageToken == "" {
 			break
 		}
+		state.setPageToken("users", pageToken)
+	}
+	state.markDone("users")
+}
+
+// directoryUserVertex is a user with the Directory attributes that matter for access
+// reviews: account state, admin roles, 2-Step Verification, logins, org unit and aliases.
+// Times are RFC 3339; lastLoginTime is 1970-01-01T00:00:00.000Z for a user that never logged in.
+func directoryUserVertex(u *admin.User) *Vertex {
+	v := userVertex(u.PrimaryEmail).
+		set("suspended", u.Suspended).
+		set("archived", u.Archived).
+		set("isAdmin", u.IsAdmin).
+		set("isDelegatedAdmin", u.IsDelegatedAdmin).
+		set("isEnrolledIn2Sv", u.IsEnrolledIn2Sv).
+		set("isEnforcedIn2Sv", u.IsEnforcedIn2Sv).
+		set("lastLoginTime", u.LastLoginTime).
+		set("creationTime", u.CreationTime).
+		set("orgUnitPath", u.OrgUnitPath)
+	if u.SuspensionReason != "" {
+		v.set("suspensionReason", u.SuspensionReason)
+	}
+	if aliases := append(append([]string{}, u.Aliases...), u.NonEditableAliases...); len(aliases) > 0 {
+		v.set("aliases", aliases)
 	}
+	return v
 }
 
 func getGroups(ctx context.Context) {
 	defer wg.Done()
 	glog.V(2).Infoln(">>>>>>>>>>> Getting Groups")
 
-	// loop over groups twice first time to get group names
-	// then group members (we do this to properly sequence the graphcreation/groovy file)
-	pageToken := ""
-	for {
-		q := adminService.Groups.List().Customer(*cx)
-		if pageToken != "" {
-			q = q.PageToken(pageToken)
-		}
-		r, err := q.Do()
-		if err != nil {
-			glog.Fatal(err)
-		}
-		for _, g := range r.Groups {
-			glog.V(4).Infoln("            Adding Group: ", g.Email)
-			entry := `	
-if (g.V().hasLabel('group').has('email','%s').hasNext() == false) {	  		  
- g.addV('group').property(label, 'group').property('email', '%s').property('isExternal', false).id().next()
-}
-`
-			entry = fmt.Sprintf(entry, g.Email, g.Email)
-			applyGroovy(entry, groupsConfig)
-
-		}
-		pageToken = r.NextPageToken
-		if pageToken == "" {
-			break
+	var previous []string
+	for _, g := range orgGraph.verticesWithLabel("group") {
+		if i := findProperty(g.Properties, "isExternal"); i >= 0 && g.Properties[i].Value == false {
+			previous = append(previous, fmt.Sprint(g.Key[0].Value))
 		}
 	}
 
-	pageToken = ""
-	for {
+	listGroups(ctx, "groups", previous, func(pageToken string) ([]string, string, error) {
 		q := adminService.Groups.List().Customer(*cx)
 		if pageToken != "" {
 			q = q.PageToken(pageToken)
 		}
-		r, err := q.Do()
+		r, err := q.Context(ctx).Do()
 		if err != nil {
-			glog.Fatal(err)
+			return nil, "", err
 		}
+		var groups []string
 		for _, g := range r.Groups {
-			time.Sleep(time.Duration(*delay) * time.Millisecond)
-			wg2.Add(1)
-			go getGroupMembers(ctx, g.Email)
-		}
-		pageToken = r.NextPageToken
-		if pageToken == "" {
-			break
+			glog.V(4).Infoln("            Adding Group: ", g.Email)
+			upsertVertex(groupVertex(g.Email).set("isExternal", false))
+			groups = append(groups, g.Email)
 		}
-	}
+		return groups, r.NextPageToken, nil
+	}, getGroupMembers)
+}
 
-	wg2.Wait()
+// groupCollector is getGroups or, with --groupsAPI=cloudidentity, getCloudIdentityGroups.
+func groupCollector() func(ctx context.Context) {
+	if *groupsAPI == "cloudidentity" {
+		return getCloudIdentityGroups
+	}
+	return getGroups
 }
 
-func getGroupMembers(ctx context.Context, memberKey string) {
-	defer wg2.Done()
+// getGroupMembers adds the members of one group to the graph and returns the groups
+// nested in it.
+func getGroupMembers(ctx context.Context, memberKey string) []string {
 	glog.V(2).Infoln(">>>>>>>>>>> Getting GroupMembers for Gropup ", memberKey)
+	unit := "group:" + memberKey
+	if nested, ok := state.isDone(unit); ok {
+		return nested
+	}
 
+	var nested []string
 	pageToken := ""
 	for {
 
@@ -286,65 +238,34 @@ func getGroupMembers(ctx context.Context, memberKey string) {
 		if pageToken != "" {
 			q = q.PageToken(pageToken)
 		}
-		r, err := q.Do()
+		r, err := q.Context(ctx).Do()
 		if err != nil {
 			if err.Error() == "googleapi: Error 403: Not Authorized to access this resource/api, forbidden" {
 				// ok, so we've got a group we can't expand on...this means we don't own it...
 				// this is important and we should error log this pretty clearly
 				glog.Infof("Group %s cannot be expanded for members;  Possibly a group outside of the Gsuites domain", memberKey)
-				return
+				state.markDone(unit, nested...)
+				return nested
 			}
-			glog.Fatal(err)
+			addError("groups", memberKey, err)
+			return nested
 		}
 		for _, m := range r.Members {
 			glog.V(4).Infof("            Adding Member to Group %v : %v", memberKey, m.Email)
 			if m.Type == "CUSTOMER" {
-				entry := `
-if (g.V().hasLabel('group').has('email','%s').hasNext() == false) {
- g1 = g.V().hasLabel('group').has('email', '%s').next()
- e1 = g.V().addE('in').to(g1).property('weight', 1).next()
-}
-`
-				entry = fmt.Sprintf(entry, memberKey, memberKey)
-				applyGroovy(entry, groupsConfig)
+				// the whole Workspace account is a member
+				id := m.Id
+				if id == "" {
+					id = *cx
+				}
+				upsertEdge(membershipEdge(customerVertex(id), memberKey, m))
 			}
 			if m.Type == "USER" {
-				entry := `
-if (g.V().hasLabel('user').has('email', '%s').hasNext() == false) {
- g.addV('user').property(label, 'user').property('email', '%s').next()			
-}
-
-u1 = g.V().hasLabel('user').has('email', '%s' ).next()
-g1 = g.V().hasLabel('group').has('email', '%s').next()
-
-if ( g.V(u1).outE('in').where(inV().hasId( g1.id() )).hasNext() == false) {
- e1 = g.V(u1).addE('in').to(g1).property('weight', 1).next()
-}
-`
-				entry = fmt.Sprintf(entry, m.Email, m.Email, m.Email, memberKey)
-				applyGroovy(entry, groupsConfig)
-
+				upsertEdge(membershipEdge(userVertex(m.Email), memberKey, m))
 			}
 			if m.Type == "GROUP" {
-				wg2.Add(1)
-
-				entry := `
-if (g.V().hasLabel('group').has('email', '%s' ).hasNext() == false) {		  		  
- g.V().hasLabel('group').has('email', '%s' ).next()
-}
-
-g1 = g.V().hasLabel('group').has('email', '%s' ).next()
-g2 = g.V().hasLabel('group').has('email', '%s').next()
-
-if (  g.V(g1).outE('in').where(inV().hasId( g2.id() )).hasNext() == false) {
- e1 = g.V(g1).addE('in').to(g2).property('weight', 1).next()
-}
-`
-				entry = fmt.Sprintf(entry, m.Email, m.Email, m.Email, memberKey)
-				applyGroovy(entry, groupsConfig)
-
-				time.Sleep(time.Duration(*delay) * time.Millisecond)
-				go getGroupMembers(ctx, m.Email)
+				upsertEdge(membershipEdge(groupVertex(m.Email), memberKey, m))
+				nested = append(nested, m.Email)
 			}
 		}
 		pageToken = r.NextPageToken
@@ -352,7 +273,21 @@ if (  g.V(g1).outE('in').where(inV().hasId( g2.id() )).hasNext() == false) {
 			break
 		}
 	}
+	state.markDone(unit, nested...)
+	return nested
+}
 
+// membershipEdge is member -in-> group with the member's role in the group (OWNER,
+// MANAGER or MEMBER), its status and, if the listing returned them, its delivery settings.
+func membershipEdge(member *Vertex, group string, m *admin.Member) *Edge {
+	e := inEdge(member, groupVertex(group)).set("role", m.Role)
+	if m.Status != "" {
+		e.set("status", m.Status)
+	}
+	if m.DeliverySettings != "" {
+		e.set("deliverySettings", m.DeliverySettings)
+	}
+	return e
 }
 
 func getProjectServiceAccounts(ctx context.Context) {
@@ -360,162 +295,105 @@ func getProjectServiceAccounts(ctx context.Context) {
 	glog.V(2).Infoln(">>>>>>>>>>> Getting ProjectServiceAccounts")
 
 	for _, p := range projects {
+		unit := "serviceaccounts:projects/" + p.ProjectId
+		if _, ok := state.isDone(unit); ok {
+			continue
+		}
 		req := iamService.Projects.ServiceAccounts.List("projects/" + p.ProjectId)
 
 		if err := req.Pages(ctx, func(page *iam.ListServiceAccountsResponse) error {
 			for _, sa := range page.Accounts {
 				glog.V(4).Infof("            Adding ServiceAccount: %v", sa.Email)
-				entry := `
-if (g.V().hasLabel('serviceAccount').has('email','%s').hasNext() == false) {
- g.addV('serviceAccount').property(label, 'serviceAccount').property('email', '%s').id().next()
-}
-`
-				entry = fmt.Sprintf(entry, sa.Email, sa.Email)
-				applyGroovy(entry, serviceAccountConfig)
-				time.Sleep(time.Duration(*delay) * time.Millisecond)
+				upsertVertex(serviceAccountVertex(sa.Email))
 			}
 			return nil
 		}); err != nil {
-			glog.Fatal(err)
+			addError("serviceaccounts", "projects/"+p.ProjectId, err)
+			continue
 		}
+		state.markDone(unit)
+	}
+}
+
+// memberVertex maps an IAM policy member (eg, user:alice@example.com) to its vertex.
+// allUsers and allAuthenticatedUsers are represented as groups, domain:example.com as a
+// domain vertex.
+func memberVertex(member string) (*Vertex, bool) {
+	if member == "allUsers" || member == "allAuthenticatedUsers" {
+		return groupVertex(member), true
 	}
+	parts := strings.SplitN(member, ":", 2)
+	if len(parts) != 2 {
+		return nil, false
+	}
+	if parts[0] == "domain" {
+		return domainVertex(strings.ToLower(parts[1])), true
+	}
+	return newVertex(parts[0], "email", parts[1]), true
 }
 
 func getGCS(ctx context.Context) {
 	defer wg.Done()
 	glog.V(2).Infoln(">>>>>>>>>>> Getting GCS")
 
-	data, err := ioutil.ReadFile(*serviceAccountFile)
+	client, err := storage.NewClient(ctx, option.WithHTTPClient(storageHTTPClient))
 	if err != nil {
-		glog.Fatal(err)
-	}
-	client, err := storage.NewClient(ctx, option.WithCredentialsJSON(data))
-	if err != nil {
-		glog.Fatalf("Failed to create client: %v", err)
+		addError("gcs", "storage client", err)
+		return
 	}
 
 	for _, p := range projects {
+		unit := "gcs:projects/" + p.ProjectId
+		if _, ok := state.isDone(unit); ok {
+			continue
+		}
 
 		wg.Add(1)
-		time.Sleep(time.Duration(*delay) * time.Millisecond)
 		go func(ctx context.Context, projectId string) {
 			defer wg.Done()
 			it := client.Buckets(ctx, projectId)
 
+			complete := true
 			for {
 				b, err := it.Next()
 				if err == iterator.Done {
 					break
 				}
 				if err != nil {
-					glog.Fatalf("Unable to iterate bucket %s", b.Name)
+					addError("gcs", "projects/"+projectId, err)
+					return
+				}
+				bucketUnit := "gcs:buckets/" + b.Name
+				if _, ok := state.isDone(bucketUnit); ok {
+					continue
 				}
 				glog.V(4).Infof("            Adding Bucket %v from Project %v", b.Name, projectId)
-				entry := `
-if (g.V().hasLabel('bucket').has('name','%s').has('projectid','%s').hasNext() == false) {
- g.addV('bucket').property(label, 'bucket').property('name', '%s').property('projectid','%s').id().next()
-}
-r1 = g.V().hasLabel('bucket').has('name','%s').has('projectid','%s').next()
+				upsertVertex(bucketVertex(b.Name).set("projectid", projectId))
+				upsertEdge(inEdge(bucketVertex(b.Name), projectVertex(projectId)))
 
-if ( g.V().hasLabel('project').has('projectid', '%s').hasNext()  == false) {
- g.addV('project').property(label, 'project').property('projectid', '%s').id().next()
-}
-
-p1 = g.V().hasLabel('project').has('projectid', '%s').next()
-
-if (g.V(r1).outE('in').where(inV().hasId( p1.id() )).hasNext() == false) {				
- e1 = g.V(r1).addE('in').to(p1).property('weight', 1).next()
-}
-`
-				entry = fmt.Sprintf(entry, b.Name, projectId, b.Name, projectId, b.Name, projectId, projectId, projectId, projectId)
-
-				policy, err := client.Bucket(b.Name).IAM().Policy(ctx)
+				// version 3 policies include the bindings' conditions
+				policy, err := client.Bucket(b.Name).IAM().V3().Policy(ctx)
 				if err != nil {
-					glog.Infof("Unable to iterate bucket policy %s", b.Name)
-				} else {
-					for _, role := range policy.Roles() {
-						//glog.Infof("        Role  %q", role)
-						glog.V(4).Infof("            Adding Role %v to Bucket %v", role, b.Name)
-
-						roleentry := `
-if (g.V().hasLabel('role').has('name','%s').hasNext() == false) {
- v = graph.addVertex('role')
- v.property('name', '%s')
-}
-
-r1 = g.V().hasLabel('role').has('name', '%s').next()
-
-if ( g.V().hasLabel('bucket').has('name', '%s').hasNext()  == false) {
- g.addV('bucket').property(label, 'bucket').property('name', '%s').property('projectid',%s).id().next()
-}
-
-p1 = g.V().hasLabel('bucket').has('name', '%s').next()
-
-if (g.V(r1).outE('in').where(inV().hasId( p1.id() )).hasNext() == false) {			
- e1 = g.V(r1).addE('in').to(p1).property('weight', 1).next()
-}
-`
-						roleentry = fmt.Sprintf(roleentry, role, role, role, b.Name, b.Name, projectId, b.Name)
-						memberentry := ``
-
-						for _, member := range policy.Members(role) {
-
-							if len(strings.Split(member, ":")) != 2 {
-								if member == "allUsers" || member == "allAuthenticatedUsers" {
-
-									glog.V(4).Infof("            Adding %s to Bucket Role %v on Bucket %v", member, role, b.Name)
-									memberType := "group"
-									email := member
-									memberentry = memberentry + `
-if (g.V().hasLabel('%s').has('email', '%s').hasNext()  == false) {
- g.addV('%s').property(label, '%s').property('email', '%s').id().next()
-}
-
-i1 = g.V().hasLabel('%s').has('email', '%s').next()
-r1 = g.V().hasLabel('role').has('name', '%s').next()
-
-if (g.V(i1).outE('in').where(inV().hasId(r1.id())).hasNext()  == false) {
- e1 = g.V(i1).addE('in').to(r1).property('weight', 1).next()
-}
-`
-
-									memberentry = fmt.Sprintf(memberentry, memberType, email, memberType, memberType, email, memberType, email, role)
-									break
-
-								} else {
-									glog.Error("            Unknown memberType  %v\n", member)
-									break
-								}
-							}
-
-							memberType := strings.Split(member, ":")[0]
-							email := strings.Split(member, ":")[1]
-							glog.V(4).Infof("            Adding Member %v to Bucket Role %v on Bucket %v", email, role, b.Name)
-							memberentry = memberentry + `																		
-if (g.V().hasLabel('%s').has('email', '%s').hasNext()  == false) {
- g.addV('%s').property(label, '%s').property('email', '%s').id().next()
-}
-
-i1 = g.V().hasLabel('%s').has('email', '%s').next()
-
-if (g.V().hasLabel('role').has('name','%s').hasNext() == false) {
-	v = graph.addVertex('role')
-}
-
-r1 = g.V().hasLabel('role').has('name', '%s').next()
-
-if (g.V(i1).outE('in').where(inV().hasId(r1.id())).hasNext()  == false) {
- e1 = g.V(i1).addE('in').to(r1).property('weight', 1).next()
-}
-`
-
-							memberentry = fmt.Sprintf(memberentry, memberType, email, memberType, memberType, email, memberType, email, role, role)
-
+					addError("gcs", "buckets/"+b.Name, err)
+					complete = false
+					continue
+				}
+				for _, pb := range policy.Bindings {
+					var cond *cloudresourcemanager.Expr
+					if pb.Condition != nil {
+						cond = &cloudresourcemanager.Expr{
+							Title:       pb.Condition.Title,
+							Expression:  pb.Condition.Expression,
+							Description: pb.Condition.Description,
 						}
-						entry = entry + roleentry + memberentry
-						applyGroovy(entry, gcsConfig)
 					}
+					glog.V(4).Infof("            Adding Role %v to Bucket %v", pb.Role, b.Name)
+					addMembers(addBinding(bucketVertex(b.Name), pb.Role, cond), pb.Members)
 				}
+				state.markDone(bucketUnit)
+			}
+			if complete {
+				state.markDone("gcs:projects/" + projectId)
 			}
 
 		}(ctx, p.ProjectId)
@@ -526,95 +404,90 @@ if (g.V(i1).outE('in').where(inV().hasId(r1.id())).hasNext()  == false) {
 func getIamPolicy(ctx context.Context, projectID string) {
 	defer wg.Done()
 	glog.V(2).Infof(">>>>>>>>>>> Getting IAMPolicy for Project %v", projectID)
-	rb := &cloudresourcemanager.GetIamPolicyRequest{}
+	if _, ok := state.isDone("IAM:projects/" + projectID); ok {
+		return
+	}
+	rb := &cloudresourcemanager.GetIamPolicyRequest{
+		Options: &cloudresourcemanager.GetPolicyOptions{RequestedPolicyVersion: iamPolicyVersion},
+	}
 
 	resp, err := crmService.Projects.GetIamPolicy(projectID, rb).Context(ctx).Do()
 	if err != nil {
-		glog.Fatal(err)
+		addError("IAM", "projects/"+projectID, err)
+		return
 	}
-	//	rs := iam.NewRolesService(iamService)
-	for _, b := range resp.Bindings {
-		glog.V(4).Infof("            Adding Binding %v to from  Project %v", b.Role, projectID)
-
-		entry := `
-if (g.V().hasLabel('role').has('name', '%s').hasNext()  == false) {
-
- v = graph.addVertex('role')
- v.property('name', '%s')
-
+	addBindings(projectVertex(projectID), resp.Bindings)
+	state.markDone("IAM:projects/" + projectID)
 }
 
-r1 = g.V().hasLabel('role').has('name', '%s').next()
+// addBindings adds a binding vertex (see addBinding) and member -in-> binding edges for
+// the bindings of a project, folder or organization policy.
+func addBindings(resource *Vertex, bindings []*cloudresourcemanager.Binding) {
+	for _, b := range bindings {
+		glog.V(4).Infof("            Adding Binding %v to from %v", b.Role, resource.ID())
 
-if ( g.V().hasLabel('project').has('projectid', '%s').hasNext()  == false) {
- g.addV('project').property(label, 'project').property('projectid', '%s').id().next()
-}
-
-p1 = g.V().hasLabel('project').has('projectid', '%s').next()
-
-if (g.V(r1).outE('in').where(inV().hasId( p1.id() )).hasNext() == false) {				
- e1 = g.V(r1).addE('in').to(p1).property('weight', 1).next()
-}
-`
-		entry = fmt.Sprintf(entry, b.Role, b.Role, b.Role, projectID, projectID, projectID)
-		applyGroovy(entry, iamConfig)
-
-		for _, m := range b.Members {
-			memberType := strings.Split(m, ":")[0]
-			email := strings.Split(m, ":")[1]
-			glog.V(4).Infof("            Adding Member %v to Role %v on Project %v", email, b.Role, projectID)
-			if memberType == "user" {
-
-				entry := `
-if (g.V().hasLabel('user').has('email', '%s').hasNext()  == false) {
- g.addV('user').property(label, 'user').property('email', '%s').id().next()
-}
-
-i1 = g.V().hasLabel('user').has('email', '%s').next()
-r1 = g.V().hasLabel('role').has('name', '%s').next()
-
-if (g.V(i1).outE('in').where(inV().hasId(r1.id())).hasNext()  == false) {
- e1 = g.V(i1).addE('in').to(r1).property('weight', 1).next()
-}
-`
-				entry = fmt.Sprintf(entry, email, email, email, b.Role)
-				applyGroovy(entry, iamConfig)
-			}
-
-			if memberType == "serviceAccount" {
-
-				entry := `
-if (g.V().hasLabel('serviceAccount').has('serviceAccount', '%s').hasNext()  == false) {
- g.addV('serviceAccount').property(label, 'serviceAccount').property('email', '%s').id().next()
+		addMembers(addBinding(resource, b.Role, b.Condition), b.Members)
+	}
 }
 
-i1 = g.V().hasLabel('serviceAccount').has('email', '%s').next()
-r1 = g.V().hasLabel('role').has('name', '%s').next()
-
-if (g.V(i1).outE('in').where(inV().hasId(r1.id())).hasNext()  == false) {
- e1 = g.V(i1).addE('in').to(r1).property('weight', 1).next()
+// the basic roles the bucket convenience members (eg, projectOwner:my-project) stand for
+var projectConvenienceRoles = map[string]string{
+	"projectOwner":  "roles/owner",
+	"projectEditor": "roles/editor",
+	"projectViewer": "roles/viewer",
+}
+
+// addMembers adds member -in-> binding edges for the members of a binding.  A bucket's
+// projectOwner:, projectEditor: or projectViewer: member is the project's binding of
+// the basic role (project binding -in-> bucket binding), so the project's owners,
+// editors and viewers are members too.  deleted: members are skipped.
+func addMembers(bv *Vertex, members []string) {
+	for _, member := range members {
+		parts := strings.SplitN(member, ":", 2)
+		if role, ok := projectConvenienceRoles[parts[0]]; ok && len(parts) == 2 {
+			glog.V(4).Infof("            Adding %v of Project %v to %v", role, parts[1], bv.ID())
+			pb := bindingVertex(projectVertex(parts[1]), role, nil)
+			upsertVertex(pb)
+			upsertEdge(inEdge(pb, bv))
+			continue
+		}
+		mv, ok := memberVertex(member)
+		if !ok || !isPrincipal(mv.Label) {
+			glog.V(4).Infof("            Skipping Member %v of %v", member, bv.ID())
+			continue
+		}
+		glog.V(4).Infof("            Adding Member %v to %v", member, bv.ID())
+		upsertEdge(inEdge(mv, bv))
+	}
 }
-`
-				entry = fmt.Sprintf(entry, email, email, email, b.Role)
-				applyGroovy(entry, iamConfig)
-			}
 
-			if memberType == "group" {
-				entry := `
-if (g.V().hasLabel('group').has('email', '%s').hasNext()  == false) {
- g.addV('group').property(label, 'group').property('email', '%s').id().next()
-}
-i1 = g.V().hasLabel('group').has('email', '%s').next()
-r1 = g.V().hasLabel('role').has('name', '%s').next()			
-if (g.V(i1).outE('in').where(inV().hasId(r1.id())).hasNext()  == false) {
- e1 = g.V(i1).addE('in').to(r1).property('weight', 1).next()
-}
-`
-				entry = fmt.Sprintf(entry, email, email, email, b.Role)
-				applyGroovy(entry, iamConfig)
-			}
-		}
+// addBinding adds the vertex for one binding of a resource's policy with
+// binding -in-> resource and binding -in-> role edges and returns it.  Members are
+// attached to the binding rather than to the (shared) role vertex, so a grant of a
+// role on one resource never appears to apply to another resource with the same role.
+func addBinding(resource *Vertex, role string, c *cloudresourcemanager.Expr) *Vertex {
+	bv := bindingVertex(resource, role, c)
+	upsertVertex(bv)
+	upsertEdge(inEdge(bv, resource))
+	upsertEdge(inEdge(bv, roleVertex(role)))
+	return bv
+}
+
+// bindingVertex is keyed on the resource, role and condition (a conditional grant
+// is a separate binding from an unconditional grant of the same role), eg.
+// project:my-project/roles/viewer or project:my-project/roles/viewer?9f86d081884c7d65
+func bindingVertex(resource *Vertex, role string, c *cloudresourcemanager.Expr) *Vertex {
+	name := resource.ID() + "/" + role
+	if c != nil {
+		h := sha256.Sum256([]byte(c.Expression))
+		name += fmt.Sprintf("?%x", h[:8])
+	}
+	v := newVertex("binding", "name", name).set("resource", resource.ID()).set("role", role)
+	if c == nil {
+		return v.set("conditional", false)
 	}
+	return v.set("conditional", true).set("condition", c.Expression).
+		set("conditionTitle", c.Title).set("conditionDescription", c.Description)
 }
 
 func getIAM(ctx context.Context) {
@@ -628,65 +501,14 @@ func getIAM(ctx context.Context) {
 	// *organization = oreq.Name
 
 	parent := fmt.Sprintf(fmt.Sprintf("organizations/%s", *organization))
-	err := generateMap(ctx, parent)
-	if err != nil {
-		glog.Fatal(err)
-	}
+	generateMap(ctx, parent)
 	for _, p := range projects {
 		parent := fmt.Sprintf("projects/%s", p.ProjectId)
-		err = generateMap(ctx, parent)
-		if err != nil {
-			glog.Fatal(err)
-		}
+		generateMap(ctx, parent)
 	}
+	// predefined roles
 	parent = ""
-	err = generateMap(ctx, parent)
-	if err != nil {
-		glog.Fatal(err)
-	}
-
-	for _, r := range roles.Roles {
-		entry := `
-if (g.V().hasLabel('role').has('name', '%s').hasNext()  == false) {		
-  g.addV('role').property(label, 'role').property('name', '%s').id().next()
-}
-`
-		entry = fmt.Sprintf(entry, r.Name, r.Name)
-		applyGroovy(entry, rolesConfig)
-	}
-	if *includePermissions {
-		for _, p := range permissions.Permissions {
-
-			pp := `
-i1 = g.V().hasLabel('permission').has('name', '%s').next()
-		`
-			pp = fmt.Sprintf(pp, p.Name)
-			rentry := ""
-
-			for _, r := range p.Roles {
-				rentry = rentry + `
-if (g.V().hasLabel('role').has('name', '%s').hasNext()  == false) {
-  g.addV('role').property(label, 'role').property('name', '%s').id().next()
-}
-r1 = g.V().hasLabel('role').has('name', '%s').next()
-e1 = g.V(i1).addE('in').to(r1).property('weight', 1).next()
-`
-				rentry = fmt.Sprintf(rentry, r, r, r)
-			}
-
-			entry := `
-if (g.V().hasLabel('permission').has('permission', '%s').hasNext()  == false) {
-  g.addV('permission').property(label, 'permission').property('name', '%s').id().next()
-}
-
-%s
-
-%s
-`
-			entry = fmt.Sprintf(entry, p.Name, p.Name, pp, rentry)
-			applyGroovy(entry, rolesConfig)
-		}
-	}
+	generateMap(ctx, parent)
 	// glog.V(2).Infof("Getting Default Roles/Permissions")
 	// parent = ""
 	// err = generateMap(ctx, parent)
@@ -695,68 +517,103 @@ if (g.V().hasLabel('permission').has('permission', '%s').hasNext()  == false) {
 	// }
 
 	glog.V(2).Infof(">>>>>>>>>>> Getting ProjectIAM")
+	getHierarchy()
+	wg.Add(1)
+	go getOrganizationIamPolicy(ctx, fmt.Sprintf("organizations/%s", *organization))
+	for _, f := range folders {
+		wg.Add(1)
+		go getFolderIamPolicy(ctx, f.Name)
+	}
 	for _, p := range projects {
-		entry := `
-if (g.V().hasLabel('project').has('projectId', '%s').hasNext() == false) {
-  g.addV('project').property(label, 'project').property('projectId', '%s').id().next()
-}
-`
-		entry = fmt.Sprintf(entry, p.ProjectId, p.ProjectId)
-		applyGroovy(entry, projectsConfig)
+		upsertVertex(projectVertex(p.ProjectId))
 		// only active projects appear to allow retrieval of IAM policies
 		if p.LifecycleState == "ACTIVE" {
-			time.Sleep(time.Duration(*delay) * time.Millisecond)
 			wg.Add(1)
 			go getIamPolicy(ctx, p.ProjectId)
 		}
 	}
 }
 
-// TODO: only get projects in the selected organization
-//       the following get allprojects the service account has access to...
-func getProjects(ctx context.Context) {
-	glog.V(2).Infof(">>>>>>>>>>> Getting Projects")
-	req := crmService.Projects.List()
-	if err := req.Pages(ctx, func(page *cloudresourcemanager.ListProjectsResponse) error {
-		for _, p := range page.Projects {
-			if p.LifecycleState == "ACTIVE" {
-				projects = append(projects, p)
-			}
-		}
-		return nil
-	}); err != nil {
-		glog.Fatal(err)
-	}
-}
-
 func main() {
 	ctx := context.Background()
 	flag.Parse()
-	limiter = rate.NewLimiter(rate.Limit(maxRequestsPerSecond), burst)
+	if flag.NArg() > 0 {
+		cmd, ok := commands[flag.Arg(0)]
+		if !ok {
+			glog.Fatalf("unknown command %q", flag.Arg(0))
+		}
+		if err := cmd(flag.Args()[1:]); err != nil {
+			glog.Fatal(err)
+		}
+		return
+	}
 	if *organization == "" || *cx == "" {
 		glog.Fatal("--organization and --cx must be specified")
 	}
+	if *delay != 0 {
+		glog.Warningf("--delay is deprecated and ignored, use the --*QPS flags to throttle the API calls")
+	}
 
 	data, err := ioutil.ReadFile(*serviceAccountFile)
 	if err != nil {
 		glog.Fatal(err)
 	}
 
-	adminconf, err := google.JWTConfigFromJSON(data,
-		admin.AdminDirectoryUserReadonlyScope, admin.AdminDirectoryGroupReadonlyScope,
-	)
+	adminconf, err := google.JWTConfigFromJSON(data, admin.AdminDirectoryUserReadonlyScope, admin.AdminDirectoryGroupReadonlyScope)
+	if err != nil {
+		glog.Fatal(err)
+	}
 	adminconf.Subject = *subject
+	adminTransport := newRetryTransport("admin", nil, apiRetryPolicy(*adminQPS))
+
+	adminService, err = admin.New(adminconf.Client(apiContext(ctx, adminTransport)))
+	if err != nil {
+		glog.Fatal(err)
+	}
+
+	// the domain and orgunit scopes get tokens of their own: with domain-wide
+	// delegation a token for a scope the admin hasn't granted fails altogether
+	domainconf, err := google.JWTConfigFromJSON(data, admin.AdminDirectoryDomainReadonlyScope)
+	if err != nil {
+		glog.Fatal(err)
+	}
+	domainconf.Subject = *subject
+	domainService, err = admin.New(domainconf.Client(apiContext(ctx, adminTransport)))
+	if err != nil {
+		glog.Fatal(err)
+	}
 
-	adminService, err = admin.New(adminconf.Client(ctx))
+	orgunitconf, err := google.JWTConfigFromJSON(data, admin.AdminDirectoryOrgunitReadonlyScope)
 	if err != nil {
 		glog.Fatal(err)
 	}
+	orgunitconf.Subject = *subject
+	orgUnitService, err = admin.New(orgunitconf.Client(apiContext(ctx, adminTransport)))
+	if err != nil {
+		glog.Fatal(err)
+	}
+
+	switch *groupsAPI {
+	case "directory":
+	case "cloudidentity":
+		ciconf, err := google.JWTConfigFromJSON(data, cloudidentity.CloudIdentityGroupsReadonlyScope)
+		if err != nil {
+			glog.Fatal(err)
+		}
+		ciconf.Subject = *subject
+		cloudIdentityService, err = cloudidentity.New(ciconf.Client(apiContext(ctx, newRetryTransport("cloudidentity", nil, apiRetryPolicy(*cloudIdentityQPS)))))
+		if err != nil {
+			glog.Fatal(err)
+		}
+	default:
+		glog.Fatalf("unknown --groupsAPI %q", *groupsAPI)
+	}
 
 	iamconf, err := google.JWTConfigFromJSON(data, iam.CloudPlatformScope)
 	if err != nil {
 		glog.Fatal(err)
 	}
-	iamclient := iamconf.Client(oauth2.NoContext)
+	iamclient := iamconf.Client(apiContext(ctx, newRetryTransport("iam", nil, apiRetryPolicy(*iamQPS))))
 
 	iamService, err = iam.New(iamclient)
 	if err != nil {
@@ -768,165 +625,216 @@ func main() {
 	if err != nil {
 		glog.Fatal(err)
 	}
-	crmclient := crmconf.Client(oauth2.NoContext)
+	crmclient := crmconf.Client(apiContext(ctx, newRetryTransport("crm", nil, apiRetryPolicy(*crmQPS))))
 
 	crmService, err = cloudresourcemanager.New(crmclient)
 	if err != nil {
 		glog.Fatal(err)
 	}
+	crmv2Service, err := crmv2.New(crmclient)
+	if err != nil {
+		glog.Fatal(err)
+	}
+	foldersService = crmv2Service.Folders
+
+	storageconf, err := google.JWTConfigFromJSON(data, storage.ScopeReadOnly)
+	if err != nil {
+		glog.Fatal(err)
+	}
+	storageHTTPClient = storageconf.Client(apiContext(ctx, newRetryTransport("storage", nil, apiRetryPolicy(*storageQPS))))
+
+	output, err = newSink(*sink)
+	if err != nil {
+		glog.Fatal(err)
+	}
+
+	if *resume {
+		if *stateFile == "" {
+			glog.Fatal("--resume needs --stateFile")
+		}
+		if err := loadState(*stateFile, orgGraph); err != nil {
+			glog.Fatal(err)
+		}
+	}
+	// the graph loaded by the previous run, to send only the changes since
+	var previous *graph
+	if *incremental {
+		if *snapshotFile == "" {
+			glog.Fatal("--incremental needs --snapshotFile")
+		}
+		sn, g, err := loadSnapshot(*snapshotFile)
+		switch {
+		case os.IsNotExist(err):
+			glog.Warningf("No snapshot in %s, writing the whole graph", *snapshotFile)
+		case err != nil:
+			glog.Fatal(err)
+		case sn.Organization != *organization || sn.Customer != *cx || sn.Component != *component:
+			glog.Fatalf("%s is a snapshot of organization %s customer %s component %s", *snapshotFile, sn.Organization, sn.Customer, sn.Component)
+		default:
+			glog.V(2).Infof(">>>>>>>>>>> Sending the changes since the snapshot saved %v", sn.Saved)
+			previous = g
+		}
+	}
+
+	stop := make(chan struct{})
+	if *stateFile != "" {
+		go checkpoint(*stateFile, *checkpointInterval, orgGraph, stop)
+	}
 
 	getProjects(ctx)
+	// only users and groups (loaded as such, or as IAM members) are classified by domain
+	if *component != "serviceaccounts" && *component != "orgunits" {
+		getDomains(ctx)
+	}
 
 	switch *component {
 	case "IAM":
-		pfile, _ = os.Create(projectsConfig)
-		ifile, _ = os.Create(iamConfig)
-		rfile, _ = os.Create(rolesConfig)
-		defer pfile.Close()
-		defer ifile.Close()
-		defer rfile.Close()
 		wg.Add(1)
 		go getIAM(ctx)
 	case "users":
-		ufile, _ = os.Create(usersConfig)
-		defer ufile.Close()
 		wg.Add(1)
 		go getUsers(ctx)
+	case "orgunits":
+		wg.Add(1)
+		go getOrgUnits(ctx)
 	case "groups":
-		gfile, _ = os.Create(groupsConfig)
-		defer gfile.Close()
 		wg.Add(1)
-		go getGroups(ctx)
+		go groupCollector()(ctx)
 	case "serviceaccounts":
-		sfile, _ = os.Create(serviceAccountConfig)
-		defer sfile.Close()
+		wg.Add(1)
 		go getProjectServiceAccounts(ctx)
 	case "gcs":
-		gcsfile, _ = os.Create(gcsConfig)
-		defer gcsfile.Close()
 		wg.Add(1)
 		go getGCS(ctx)
 
 	default:
-
-		pfile, _ = os.Create(projectsConfig)
-		ufile, _ = os.Create(usersConfig)
-		sfile, _ = os.Create(serviceAccountConfig)
-		ifile, _ = os.Create(iamConfig)
-		rfile, _ = os.Create(rolesConfig)
-		gfile, _ = os.Create(groupsConfig)
-		gcsfile, _ = os.Create(gcsConfig)
-
-		defer pfile.Close()
-		defer ufile.Close()
-		defer sfile.Close()
-		defer ifile.Close()
-		defer rfile.Close()
-		defer gfile.Close()
-		defer gcsfile.Close()
-
-		wg.Add(5)
+		wg.Add(6)
 		go getUsers(ctx)
-		go getGroups(ctx)
+		go getOrgUnits(ctx)
+		go groupCollector()(ctx)
 		go getProjectServiceAccounts(ctx)
 		go getIAM(ctx)
 		go getGCS(ctx)
 	}
 	wg.Wait()
+	close(stop)
+	classifyPrincipals(orgGraph)
+	if *stateFile != "" {
+		if err := saveState(*stateFile, orgGraph); err != nil {
+			glog.Error(err)
+		}
+	}
+
+	vc, ec := orgGraph.counts()
+	glog.V(2).Infof(">>>>>>>>>>> Graph has vertices %v edges %v", vc, ec)
+	var outputErr error
+	if previous != nil {
+		d := diffGraphs(previous, orgGraph)
+		if errorCount() > 0 {
+			glog.Warningf("Some resources failed to load, nothing is removed from the graph")
+			d.keepRemoved(orgGraph)
+		}
+		added, changed, removed := d.counts()
+		glog.V(2).Infof(">>>>>>>>>>> %d added, %d changed, %d removed since the snapshot", added, changed, removed)
+		outputErr = writeChanges(output, d, orgGraph)
+	} else {
+		outputErr = output.WriteGraph(orgGraph)
+	}
+	if err := output.Close(); err != nil && outputErr == nil {
+		outputErr = err
+	}
+	if outputErr != nil {
+		addError("output", *sink, outputErr)
+	} else if *snapshotFile != "" {
+		// only once the sinks have it, the snapshot has to match the graph database
+		if err := saveSnapshot(*snapshotFile, orgGraph); err != nil {
+			glog.Error(err)
+		}
+	}
+	if err := writeFindings(*findingsFile); err != nil {
+		glog.Error(err)
+	}
+	if err := writeErrors(*errorsFile); err != nil {
+		glog.Error(err)
+	}
+	if n := errorCount(); *maxErrors >= 0 && n > *maxErrors {
+		glog.Errorf("%d resources failed to load (--maxErrors=%d)", n, *maxErrors)
+		glog.Flush()
+		os.Exit(2)
+	}
+}
 
+// apiRetryPolicy is the --maxRetries/--minBackoff/--maxBackoff policy with the API's own rate limit.
+func apiRetryPolicy(qps float64) retryPolicy {
+	burst := int(qps)
+	if burst < 1 {
+		burst = 1
+	}
+	return retryPolicy{
+		qps:        qps,
+		burst:      burst,
+		maxRetries: *maxRetries,
+		minBackoff: *minBackoff,
+		maxBackoff: *maxBackoff,
+	}
 }
 
-func generateMap(ctx context.Context, parent string) error {
+// generateMap adds the roles defined in parent ("" for the predefined roles) and, with
+// --includePermissions, permission -in-> role edges for the permissions they include.
+func generateMap(ctx context.Context, parent string) {
+	unit := "roles:" + parent
+	if _, ok := state.isDone(unit); ok {
+		return
+	}
 	var wg sync.WaitGroup
+	var failed int32
 
 	oireq := ors.List().Parent(parent)
-	if err := oireq.Pages(ctx, func(page *iam.ListRolesResponse) error {
+	err := oireq.Pages(ctx, func(page *iam.ListRolesResponse) error {
 		for _, sa := range page.Roles {
 			wg.Add(1)
 			go func(ctx context.Context, wg *sync.WaitGroup, sa *iam.Role) {
 				glog.V(20).Infof("%s\n", sa.Name)
 				defer wg.Done()
-				var err error
-				if err := limiter.Wait(ctx); err != nil {
-					glog.Fatal(err)
-				}
-				if ctx.Err() != nil {
-					glog.Fatal(err)
-				}
-				rc, err := ors.Get(sa.Name).Do()
+				rc, err := ors.Get(sa.Name).Context(ctx).Do()
 				if err != nil {
-					glog.Fatal(err)
-				}
-				cr := &Role{
-					Name:                sa.Name,
-					Role:                *sa,
-					IncludedPermissions: rc.IncludedPermissions,
+					addError("IAM", sa.Name, err)
+					atomic.StoreInt32(&failed, 1)
+					return
 				}
-				cmutex.Lock()
-				_, ok := findRoles(roles.Roles, sa.Name)
-				if !ok {
-					glog.V(2).Infof("     Iterating Role  %s", sa.Name)
-					roles.Roles = append(roles.Roles, *cr)
+				glog.V(2).Infof("     Iterating Role  %s", sa.Name)
+				upsertVertex(roleVertex(sa.Name))
+				if !*includePermissions {
+					return
 				}
-				cmutex.Unlock()
-
 				for _, perm := range rc.IncludedPermissions {
 					glog.V(2).Infof("     Appending Permission %s to Role %s", perm, sa.Name)
-					i, ok := findPermission(permissions.Permissions, perm)
-
-					if !ok {
-						pmutex.Lock()
-						permissions.Permissions = append(permissions.Permissions, Permission{
-							Name:  perm,
-							Roles: []string{sa.Name},
-						})
-						pmutex.Unlock()
-					} else {
-						pmutex.Lock()
-						p := permissions.Permissions[i]
-						_, ok := find(p.Roles, sa.Name)
-						if !ok {
-							p.Roles = append(p.Roles, sa.Name)
-							permissions.Permissions[i] = p
-						}
-						pmutex.Unlock()
-					}
-
+					upsertVertex(permissionVertex(perm))
+					upsertEdge(inEdge(permissionVertex(perm), roleVertex(sa.Name)))
 				}
 			}(ctx, &wg, sa)
 
 		}
 		return nil
-	}); err != nil {
-		return err
-	}
-
+	})
 	wg.Wait()
 
-	return nil
-}
-
-func find(slice []string, val string) (int, bool) {
-	for i, item := range slice {
-		if item == val {
-			return i, true
+	if err != nil {
+		if parent == "" {
+			addError("IAM", "roles", err)
+		} else {
+			addError("IAM", parent+"/roles", err)
 		}
+		return
 	}
-	return -1, false
-}
-
-func findRoles(slice []Role, val string) (int, bool) {
-	for i, item := range slice {
-		if item.Name == val {
-			return i, true
-		}
+	if atomic.LoadInt32(&failed) == 0 {
+		state.markDone(unit)
 	}
-	return -1, false
 }
 
-func findPermission(slice []Permission, val string) (int, bool) {
+func find(slice []string, val string) (int, bool) {
 	for i, item := range slice {
-		if item.Name == val {
+		if item == val {
 			return i, true
 		}
 	}
@@ -0,0 +1,225 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Values read from the Directory, IAM and Storage APIs are never spliced into the
+// generated scripts.  A mutation either binds them as parameters (when the script is
+// submitted to a Gremlin Server) or renders them as escaped groovy string literals
+// (when the script is written to a .groovy file).
+
+// statement is a rendered mutation.  When params is set the script refers to
+// them as p.<name>.
+type statement struct {
+	script string
+	params map[string]interface{}
+}
+
+type mutation struct {
+	bind   bool
+	script strings.Builder
+	params map[string]interface{}
+}
+
+// newMutation starts a mutation; bound parameters are used if the statement is
+// going to a Gremlin Server, escaped literals otherwise.
+func newMutation(bind bool) *mutation {
+	m := &mutation{bind: bind}
+	if m.bind {
+		m.params = make(map[string]interface{})
+	}
+	return m
+}
+
+// value returns the groovy expression that evaluates to v.
+func (m *mutation) value(v interface{}) string {
+	if m.bind {
+		name := "v" + strconv.Itoa(len(m.params))
+		m.params[name] = v
+		return "p." + name
+	}
+	return groovyLiteral(v)
+}
+
+func (m *mutation) lookup(v *Vertex) string {
+	return "g.V()." + m.match(v)
+}
+
+// match renders the steps that filter vertices down to v.
+func (m *mutation) match(v *Vertex) string {
+	return "hasLabel(" + m.value(v.Label) + ")" + m.has(v.Key)
+}
+
+func (m *mutation) has(key []Property) string {
+	s := ""
+	for _, k := range key {
+		s = s + ".has(" + m.value(k.Key) + ", " + m.value(k.Value) + ")"
+	}
+	return s
+}
+
+// keys renders the names of the properties as arguments to properties().
+func (m *mutation) keys(props []Property) string {
+	names := make([]string, len(props))
+	for i, p := range props {
+		names[i] = m.value(p.Key)
+	}
+	return strings.Join(names, ", ")
+}
+
+// properties renders the .property() steps; multi-valued ([]string) properties are
+// added once per value with list cardinality.
+func (m *mutation) properties(props []Property) string {
+	s := ""
+	for _, p := range props {
+		if l, ok := p.Value.([]string); ok {
+			for _, v := range l {
+				s = s + ".property(list, " + m.value(p.Key) + ", " + m.value(v) + ")"
+			}
+			continue
+		}
+		s = s + ".property(" + m.value(p.Key) + ", " + m.value(p.Value) + ")"
+	}
+	return s
+}
+
+// upsertVertex adds the vertex (with its key and properties) unless a vertex with the same key exists.
+func (m *mutation) upsertVertex(v *Vertex) {
+	fmt.Fprintf(&m.script, `
+if (%s.hasNext() == false) {
+ g.addV(%s)%s%s.next()
+}
+`, m.lookup(v), m.value(v.Label), m.properties(v.Key), m.properties(v.Properties))
+}
+
+// upsertEdge adds the edge unless one with the same label already connects the two
+// vertices; both vertices must have been added before.
+func (m *mutation) upsertEdge(e *Edge) {
+	label := m.value(e.Label)
+	fmt.Fprintf(&m.script, `
+v1 = %s.next()
+v2 = %s.next()
+if (g.V(v1).outE(%s).where(inV().hasId(v2.id())).hasNext() == false) {
+ g.V(v1).addE(%s).to(v2)%s.next()
+}
+`, m.lookup(e.From), m.lookup(e.To), label, label, m.properties(e.Properties))
+}
+
+// updateVertex replaces the properties old had with the ones v has, adding v if it
+// doesn't exist.
+func (m *mutation) updateVertex(old, v *Vertex) {
+	lookup := m.lookup(v)
+	drop := ""
+	if len(old.Properties) > 0 {
+		drop = fmt.Sprintf(" %s.properties(%s).drop().iterate()\n", lookup, m.keys(old.Properties))
+	}
+	fmt.Fprintf(&m.script, `
+if (%s.hasNext() == false) {
+ g.addV(%s)%s%s.next()
+} else {
+%s %s%s.iterate()
+}
+`, lookup, m.value(v.Label), m.properties(v.Key), m.properties(v.Properties), drop, lookup, m.properties(v.Properties))
+}
+
+// updateEdge replaces the properties old had with the ones e has, adding e if it
+// doesn't exist; both vertices must exist.
+func (m *mutation) updateEdge(old, e *Edge) {
+	label := m.value(e.Label)
+	edge := "g.V(v1).outE(" + label + ").where(inV().hasId(v2.id()))"
+	drop := ""
+	if len(old.Properties) > 0 {
+		drop = fmt.Sprintf(" %s.properties(%s).drop().iterate()\n", edge, m.keys(old.Properties))
+	}
+	fmt.Fprintf(&m.script, `
+v1 = %s.next()
+v2 = %s.next()
+if (%s.hasNext() == false) {
+ g.V(v1).addE(%s).to(v2)%s.next()
+} else {
+%s %s%s.iterate()
+}
+`, m.lookup(e.From), m.lookup(e.To), edge, label, m.properties(e.Properties), drop, edge, m.properties(e.Properties))
+}
+
+// dropVertex removes the vertex, and with it its edges, if it exists.
+func (m *mutation) dropVertex(v *Vertex) {
+	fmt.Fprintf(&m.script, "\n%s.drop().iterate()\n", m.lookup(v))
+}
+
+// dropEdge removes the edge if it exists.
+func (m *mutation) dropEdge(e *Edge) {
+	fmt.Fprintf(&m.script, "\n%s.outE(%s).where(inV().%s).drop().iterate()\n", m.lookup(e.From), m.value(e.Label), m.match(e.To))
+}
+
+func (m *mutation) statement() statement {
+	return statement{script: m.script.String(), params: m.params}
+}
+
+// groovyLiteral renders v as a groovy literal.  Strings are single quoted (no GString
+// interpolation) with quotes, backslashes and control characters escaped so that no
+// input can terminate the literal.
+func groovyLiteral(v interface{}) string {
+	switch t := v.(type) {
+	case bool:
+		return strconv.FormatBool(t)
+	case int:
+		return strconv.Itoa(t)
+	case int64:
+		return strconv.FormatInt(t, 10)
+	case string:
+		return quoteLiteral(t)
+	default:
+		return quoteLiteral(fmt.Sprint(t))
+	}
+}
+
+// quoteLiteral renders s as a single quoted string literal.  Groovy and Cypher accept
+// the same escapes (\', \\, \n... and \uXXXX), so both use it.
+func quoteLiteral(s string) string {
+	var b strings.Builder
+	b.WriteByte('\'')
+	for _, r := range s {
+		switch r {
+		case '\'':
+			b.WriteString(`\'`)
+		case '\\':
+			b.WriteString(`\\`)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\r':
+			b.WriteString(`\r`)
+		case '\t':
+			b.WriteString(`\t`)
+		case '\b':
+			b.WriteString(`\b`)
+		case '\f':
+			b.WriteString(`\f`)
+		default:
+			if r < 0x20 || r == 0x7f || r == 0x2028 || r == 0x2029 {
+				fmt.Fprintf(&b, `\u%04x`, r)
+			} else {
+				b.WriteRune(r)
+			}
+		}
+	}
+	b.WriteByte('\'')
+	return b.String()
+}
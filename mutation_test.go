@@ -0,0 +1,219 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"testing/quick"
+)
+
+// hostileString is a string made mostly of the characters that could end or alter a
+// quoted literal, for testing/quick.
+type hostileString string
+
+var hostileRunes = []rune{'\'', '"', '\\', '$', '{', '}', '`', 'u', '0', '2', '7', 'a', ' ',
+	'\n', '\r', '\t', '\b', '\f', '\x00', '\x1b', '\x7f', '\u0085', '\u2028', '\u2029', '\ufeff', '😀'}
+
+func (hostileString) Generate(r *rand.Rand, size int) reflect.Value {
+	b := make([]rune, r.Intn(size+1))
+	for i := range b {
+		if r.Intn(4) == 0 {
+			b[i] = rune(r.Intn(0x3000))
+		} else {
+			b[i] = hostileRunes[r.Intn(len(hostileRunes))]
+		}
+	}
+	return reflect.ValueOf(hostileString(b))
+}
+
+// hostileInputs are spelled out as well as generated.
+var hostileInputs = []string{
+	"",
+	"'",
+	"''",
+	"'''",
+	`\`,
+	`\'`,
+	`'\`,
+	`\u0027`,
+	`\\u0027`,
+	`\u005c`,
+	"$x",
+	"${'x'.execute()}",
+	"'); g.V().drop().iterate(); ('",
+	"a\nb\r\nc",
+	"\x00\x01\x1f\x7f",
+	"line\u2028separator\u2029paragraph",
+	"*/ // /*",
+}
+
+// unquoteLiteral parses a single quoted literal as rendered by quoteLiteral, the way
+// groovy or cypher reads it.  It fails on anything the renderer must never produce: a quote,
+// backslash or control character outside an escape, text after the closing quote, or
+// a unicode escape for a quote or a backslash.
+func unquoteLiteral(lit string) (string, error) {
+	if len(lit) < 2 || lit[0] != '\'' || lit[len(lit)-1] != '\'' {
+		return "", fmt.Errorf("%q is not single quoted", lit)
+	}
+	r := []rune(lit[1 : len(lit)-1])
+	var b strings.Builder
+	for i := 0; i < len(r); i++ {
+		c := r[i]
+		switch {
+		case c == '\'':
+			return "", fmt.Errorf("unescaped quote at %d in %q", i, lit)
+		case c < 0x20 || c == 0x7f || c == 0x2028 || c == 0x2029:
+			return "", fmt.Errorf("raw control character %U at %d in %q", c, i, lit)
+		case c != '\\':
+			b.WriteRune(c)
+			continue
+		}
+		i++
+		if i == len(r) {
+			return "", fmt.Errorf("dangling backslash in %q", lit)
+		}
+		switch r[i] {
+		case '\'', '\\':
+			b.WriteRune(r[i])
+		case 'n':
+			b.WriteByte('\n')
+		case 'r':
+			b.WriteByte('\r')
+		case 't':
+			b.WriteByte('\t')
+		case 'b':
+			b.WriteByte('\b')
+		case 'f':
+			b.WriteByte('\f')
+		case 'u':
+			if i+4 >= len(r) {
+				return "", fmt.Errorf("short unicode escape in %q", lit)
+			}
+			n, err := strconv.ParseUint(string(r[i+1:i+5]), 16, 32)
+			if err != nil {
+				return "", fmt.Errorf("bad unicode escape in %q: %v", lit, err)
+			}
+			if n == '\'' || n == '\\' {
+				return "", fmt.Errorf("quote or backslash as a unicode escape in %q", lit)
+			}
+			b.WriteRune(rune(n))
+			i += 4
+		default:
+			return "", fmt.Errorf("unknown escape \\%c in %q", r[i], lit)
+		}
+	}
+	return b.String(), nil
+}
+
+// roundTrip checks that quote renders s as a literal that evaluates back to s.
+func roundTrip(t *testing.T, quote func(string) string, s string) bool {
+	got, err := unquoteLiteral(quote(s))
+	if err != nil {
+		t.Error(err)
+		return false
+	}
+	if got != s {
+		t.Errorf("%q rendered as %s reads back as %q", s, quote(s), got)
+		return false
+	}
+	return true
+}
+
+func TestQuoteLiteral(t *testing.T) {
+	for _, s := range hostileInputs {
+		roundTrip(t, quoteLiteral, s)
+	}
+	f := func(s hostileString) bool { return roundTrip(t, quoteLiteral, string(s)) }
+	if err := quick.Check(f, &quick.Config{MaxCount: 5000}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestGroovyLiteral(t *testing.T) {
+	for _, tc := range []struct {
+		v    interface{}
+		want string
+	}{
+		{true, "true"},
+		{42, "42"},
+		{int64(-7), "-7"},
+		{"it's", `'it\'s'`},
+		{[]string{"a'b"}, `'[a\'b]'`},
+	} {
+		if got := groovyLiteral(tc.v); got != tc.want {
+			t.Errorf("groovyLiteral(%#v) = %s, want %s", tc.v, got, tc.want)
+		}
+	}
+}
+
+// In bound parameter mode no value reaches the script: the script of a mutation only
+// depends on the shape of the vertices and edges, and the values are all parameters.
+func TestBoundParameters(t *testing.T) {
+	render := func(a, b, c, d hostileString) (statement, *Edge) {
+		e := inEdge(newVertex("user", "email", string(a)).set(string(b), string(c)),
+			newVertex("group", "email", string(d)))
+		e.set("role", string(c))
+		m := newMutation(true)
+		m.upsertVertex(e.From)
+		m.updateVertex(e.From, e.From)
+		m.upsertEdge(e)
+		m.updateEdge(e, e)
+		m.dropEdge(e)
+		m.dropVertex(e.To)
+		return m.statement(), e
+	}
+	want, _ := render("x", "y", "z", "w")
+	f := func(a, b, c, d hostileString) bool {
+		st, _ := render(a, b, c, d)
+		if st.script != want.script {
+			t.Errorf("script depends on the values %q %q %q %q:\n%s", a, b, c, d, st.script)
+			return false
+		}
+		values := make(map[interface{}]bool)
+		for _, v := range st.params {
+			values[v] = true
+		}
+		for _, v := range []hostileString{a, b, c, d} {
+			if !values[string(v)] {
+				t.Errorf("%q is not bound as a parameter: %v", v, st.params)
+				return false
+			}
+		}
+		return true
+	}
+	if err := quick.Check(f, &quick.Config{MaxCount: 1000}); err != nil {
+		t.Error(err)
+	}
+}
+
+// In literal mode every value in the script is an escaped literal.
+func TestLiteralMutation(t *testing.T) {
+	for _, s := range hostileInputs {
+		m := newMutation(false)
+		m.upsertVertex(userVertex(s).set("name", s))
+		st := m.statement()
+		if st.params != nil {
+			t.Errorf("literal mutation has parameters: %v", st.params)
+		}
+		if n := strings.Count(st.script, quoteLiteral(s)); n != 3 {
+			t.Errorf("%q is rendered %d times as %s, want 3:\n%s", s, n, quoteLiteral(s), st.script)
+		}
+	}
+}
@@ -0,0 +1,270 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// cypherSink writes idempotent MERGE statements that can be run with cypher-shell, eg.
+// cypher-shell -f graph.cypher
+// Vertices are merged on their key properties with the same labels as the groovy output.
+type cypherSink struct {
+	mu sync.Mutex
+	f  *os.File
+	w  *bufio.Writer
+}
+
+func newCypherSink(path string) (*cypherSink, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	return &cypherSink{f: f, w: bufio.NewWriter(f)}, nil
+}
+
+func cypherNode(name string, v *Vertex) string {
+	return "(" + name + ":" + cypherName(v.Label) + cypherMap(v.Key) + ")"
+}
+
+func cypherMap(props []Property) string {
+	if len(props) == 0 {
+		return ""
+	}
+	keys := make([]string, len(props))
+	for i, k := range props {
+		keys[i] = cypherName(k.Key) + ": " + cypherLiteral(k.Value)
+	}
+	return " {" + strings.Join(keys, ", ") + "}"
+}
+
+// cypherProperties renders a map literal with all the properties, eg. for SET n = {...}
+func cypherProperties(props []Property) string {
+	if len(props) == 0 {
+		return "{}"
+	}
+	return strings.TrimPrefix(cypherMap(props), " ")
+}
+
+func cypherSet(name string, props []Property) string {
+	if len(props) == 0 {
+		return ""
+	}
+	sets := make([]string, len(props))
+	for i, p := range props {
+		sets[i] = name + "." + cypherName(p.Key) + " = " + cypherLiteral(p.Value)
+	}
+	return " SET " + strings.Join(sets, ", ")
+}
+
+func (s *cypherSink) WriteGraph(g *graph) error {
+	return streamGraph(s, g)
+}
+
+func (s *cypherSink) UpsertVertex(v *Vertex) error {
+	return s.write("MERGE " + cypherNode("n", v) + cypherSet("n", v.Properties) + ";\n")
+}
+
+func (s *cypherSink) UpsertEdge(e *Edge) error {
+	return s.write("MERGE " + cypherNode("a", e.From) + " MERGE " + cypherNode("b", e.To) +
+		" MERGE (a)-[r:" + cypherName(e.Label) + "]->(b)" + cypherSet("r", e.Properties) + ";\n")
+}
+
+// UpdateVertex replaces all the properties of the node with the vertex's.
+func (s *cypherSink) UpdateVertex(old, v *Vertex) error {
+	return s.write("MERGE " + cypherNode("n", v) + " SET n = " + cypherProperties(v.allProperties()) + ";\n")
+}
+
+func (s *cypherSink) UpdateEdge(old, e *Edge) error {
+	return s.write("MERGE " + cypherNode("a", e.From) + " MERGE " + cypherNode("b", e.To) +
+		" MERGE (a)-[r:" + cypherName(e.Label) + "]->(b) SET r = " + cypherProperties(e.Properties) + ";\n")
+}
+
+func (s *cypherSink) DropVertex(v *Vertex) error {
+	return s.write("MATCH " + cypherNode("n", v) + " DETACH DELETE n;\n")
+}
+
+func (s *cypherSink) DropEdge(e *Edge) error {
+	return s.write("MATCH " + cypherNode("a", e.From) + "-[r:" + cypherName(e.Label) + "]->" + cypherNode("b", e.To) + " DELETE r;\n")
+}
+
+func (s *cypherSink) write(cmd string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err := s.w.WriteString(cmd)
+	return err
+}
+
+func (s *cypherSink) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.w.Flush()
+}
+
+func (s *cypherSink) Close() error {
+	if err := s.Flush(); err != nil {
+		s.f.Close()
+		return err
+	}
+	return s.f.Close()
+}
+
+// cypherName quotes a label, relationship type or property key with backticks.
+func cypherName(s string) string {
+	return "`" + strings.Replace(s, "`", "``", -1) + "`"
+}
+
+func cypherLiteral(v interface{}) string {
+	switch t := v.(type) {
+	case bool:
+		return strconv.FormatBool(t)
+	case int:
+		return strconv.Itoa(t)
+	case int64:
+		return strconv.FormatInt(t, 10)
+	case []string:
+		l := make([]string, len(t))
+		for i, s := range t {
+			l[i] = quoteLiteral(s)
+		}
+		return "[" + strings.Join(l, ", ") + "]"
+	case string:
+		return quoteLiteral(t)
+	}
+	return quoteLiteral(fmt.Sprint(v))
+}
+
+// neo4jImportSink writes the node and relationship CSV files for
+// neo4j-admin database import: one nodes_<label>.csv per vertex label and one
+// relationships_<label>.csv per edge label, using the stable vertex ids.
+type neo4jImportSink struct {
+	dir string
+}
+
+func newNeo4jImportSink(dir string) *neo4jImportSink {
+	return &neo4jImportSink{dir: dir}
+}
+
+// Close does nothing, WriteGraph writes and closes the files.
+func (s *neo4jImportSink) Close() error {
+	return nil
+}
+
+// WriteGraph rewrites the files with the graph.
+func (s *neo4jImportSink) WriteGraph(g *graph) error {
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return err
+	}
+
+	nodes := make(map[string][][]Property)
+	for _, v := range g.sortedVertices() {
+		props := append([]Property{{"id:ID", v.ID()}, {":LABEL", v.Label}}, v.allProperties()...)
+		nodes[v.Label] = append(nodes[v.Label], props)
+	}
+	for label, rows := range nodes {
+		if err := writeNeo4jCSV(filepath.Join(s.dir, "nodes_"+label+".csv"), rows); err != nil {
+			return err
+		}
+	}
+
+	rels := make(map[string][][]Property)
+	for _, e := range g.sortedEdges() {
+		props := append([]Property{{":START_ID", e.From.ID()}, {":END_ID", e.To.ID()}, {":TYPE", e.Label}}, e.Properties...)
+		rels[e.Label] = append(rels[e.Label], props)
+	}
+	for label, rows := range rels {
+		if err := writeNeo4jCSV(filepath.Join(s.dir, "relationships_"+label+".csv"), rows); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeNeo4jCSV writes the rows under a header that is the union of their property
+// keys, typed the way neo4j-admin expects (eg. isExternal:boolean, aliases:string[]).
+func writeNeo4jCSV(path string, rows [][]Property) error {
+	var columns []string
+	types := make(map[string]string)
+	for _, row := range rows {
+		for _, p := range row {
+			if _, ok := types[p.Key]; !ok {
+				columns = append(columns, p.Key)
+			}
+			types[p.Key] = neo4jType(p.Value)
+		}
+	}
+	// the id/label columns come first, the rest in a stable order
+	fixed := 0
+	for fixed < len(columns) && strings.Contains(columns[fixed], ":") {
+		fixed++
+	}
+	sort.Strings(columns[fixed:])
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	w := csv.NewWriter(f)
+	header := make([]string, len(columns))
+	for i, c := range columns {
+		header[i] = c + types[c]
+	}
+	w.Write(header)
+	for _, row := range rows {
+		record := make([]string, len(columns))
+		for i, c := range columns {
+			if j := findProperty(row, c); j >= 0 {
+				record[i] = neo4jValue(row[j].Value)
+			}
+		}
+		w.Write(record)
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func neo4jType(v interface{}) string {
+	switch v.(type) {
+	case bool:
+		return ":boolean"
+	case int:
+		return ":int"
+	case int64:
+		return ":long"
+	case []string:
+		return ":string[]"
+	}
+	return ""
+}
+
+// neo4jValue formats a CSV field; arrays use neo4j-admin's default ';' delimiter.
+func neo4jValue(v interface{}) string {
+	if l, ok := v.([]string); ok {
+		return strings.Join(l, ";")
+	}
+	return fmt.Sprint(v)
+}
@@ -0,0 +1,57 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"strings"
+	"testing"
+	"testing/quick"
+)
+
+func TestCypherName(t *testing.T) {
+	f := func(s hostileString) bool {
+		q := cypherName(string(s))
+		inner := q[1 : len(q)-1]
+		if q[0] != '`' || q[len(q)-1] != '`' || strings.Contains(strings.Replace(inner, "``", "", -1), "`") {
+			t.Errorf("%q is quoted as %s", s, q)
+			return false
+		}
+		if got := strings.Replace(inner, "``", "`", -1); got != string(s) {
+			t.Errorf("%q quoted as %s reads back as %q", s, q, got)
+			return false
+		}
+		return true
+	}
+	if err := quick.Check(f, &quick.Config{MaxCount: 5000}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCypherLiteral(t *testing.T) {
+	for _, tc := range []struct {
+		v    interface{}
+		want string
+	}{
+		{false, "false"},
+		{42, "42"},
+		{int64(-7), "-7"},
+		{"it's", `'it\'s'`},
+		{[]string{"a'b", `c\`}, `['a\'b', 'c\\']`},
+	} {
+		if got := cypherLiteral(tc.v); got != tc.want {
+			t.Errorf("cypherLiteral(%#v) = %s, want %s", tc.v, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+)
+
+// the root organizational unit, which the Directory API doesn't list
+const rootOrgUnit = "/"
+
+func orgUnitVertex(path string) *Vertex {
+	return newVertex("orgUnit", "path", path)
+}
+
+// getOrgUnits adds the customer's organizational units with orgUnit -in-> parent
+// edges up to the root ("/").  Users are linked to their unit by getUsers.
+func getOrgUnits(ctx context.Context) {
+	defer wg.Done()
+	glog.V(2).Infoln(">>>>>>>>>>> Getting OrgUnits")
+	if _, ok := state.isDone("orgunits"); ok {
+		return
+	}
+
+	r, err := orgUnitService.Orgunits.List(*cx).Type("all").Context(ctx).Do()
+	if err != nil {
+		addError("orgunits", "customers/"+*cx, err)
+		return
+	}
+	upsertVertex(orgUnitVertex(rootOrgUnit).set("name", rootOrgUnit))
+	for _, ou := range r.OrganizationUnits {
+		glog.V(4).Infof("            Adding OrgUnit %v in %v", ou.OrgUnitPath, ou.ParentOrgUnitPath)
+		upsertVertex(orgUnitVertex(ou.OrgUnitPath).
+			set("name", ou.Name).
+			set("orgUnitId", ou.OrgUnitId).
+			set("description", ou.Description).
+			set("blockInheritance", ou.BlockInheritance))
+		parent := ou.ParentOrgUnitPath
+		if parent == "" {
+			parent = rootOrgUnit
+		}
+		upsertEdge(inEdge(orgUnitVertex(ou.OrgUnitPath), orgUnitVertex(parent)))
+	}
+	state.markDone("orgunits")
+}
@@ -0,0 +1,564 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// graphIndex answers traversals over a snapshot's graph without a graph database:
+// the 'in' edges of every vertex, in both directions.
+type graphIndex struct {
+	g   *graph
+	out map[string][]*Edge
+	in  map[string][]*Edge
+	// escalation flags the access a principal can also grant to others because it owns or
+	// manages the group it gets it through (see manages)
+	escalation bool
+}
+
+func newGraphIndex(g *graph) *graphIndex {
+	x := &graphIndex{g: g, out: make(map[string][]*Edge), in: make(map[string][]*Edge)}
+	for _, e := range g.sortedEdges() {
+		if e.Label != "in" {
+			continue
+		}
+		x.addEdge(e)
+	}
+	x.expandAccounts()
+	return x
+}
+
+func (x *graphIndex) addEdge(e *Edge) {
+	x.out[e.From.ID()] = append(x.out[e.From.ID()], e)
+	x.in[e.To.ID()] = append(x.in[e.To.ID()], e)
+}
+
+// expandAccounts adds the members of domains and of the Workspace account to the index
+// (they have no edges in the graph): user -in-> domain for every user of a domain and,
+// for an account whose domains are unknown, user -in-> customer for every user of the
+// account (the users listed by getUsers, see isExternal).
+func (x *graphIndex) expandAccounts() {
+	domains := make(map[string]*Vertex)
+	for _, d := range x.g.verticesWithLabel("domain") {
+		domains[fmt.Sprint(d.Key[0].Value)] = d
+	}
+	users := x.g.verticesWithLabel("user")
+	for _, u := range users {
+		if d, ok := domains[emailDomain(fmt.Sprint(u.Key[0].Value))]; ok {
+			x.addEdge(inEdge(u, d))
+		}
+	}
+	for _, c := range x.g.verticesWithLabel("customer") {
+		hasDomains := false
+		for _, e := range x.in[c.ID()] {
+			if e.From.Label == "domain" {
+				hasDomains = true
+			}
+		}
+		if hasDomains {
+			continue
+		}
+		for _, u := range users {
+			if i := findProperty(u.Properties, "isExternal"); i >= 0 && u.Properties[i].Value == false {
+				x.addEdge(inEdge(u, c))
+			}
+		}
+	}
+}
+
+func (x *graphIndex) vertex(id string) (*Vertex, bool) {
+	x.g.mu.Lock()
+	defer x.g.mu.Unlock()
+	v, ok := x.g.vertices[id]
+	return v, ok
+}
+
+// resource finds the vertex for a resource given as projects/<id>, buckets/<name>
+// (or gs://<name>), folders/<id>, organizations/<id> or a vertex id (eg, project:my-project).
+func (x *graphIndex) resource(name string) (*Vertex, error) {
+	var v *Vertex
+	switch {
+	case strings.HasPrefix(name, "projects/"):
+		v = projectVertex(strings.TrimPrefix(name, "projects/"))
+	case strings.HasPrefix(name, "buckets/"):
+		v = bucketVertex(strings.TrimPrefix(name, "buckets/"))
+	case strings.HasPrefix(name, "gs://"):
+		v = bucketVertex(strings.TrimSuffix(strings.TrimPrefix(name, "gs://"), "/"))
+	case strings.HasPrefix(name, "folders/"):
+		v = folderVertex(name)
+	case strings.HasPrefix(name, "organizations/"):
+		v = organizationVertex(name)
+	}
+	id := name
+	if v != nil {
+		id = v.ID()
+	}
+	if found, ok := x.vertex(id); ok {
+		return found, nil
+	}
+	return nil, fmt.Errorf("%s is not in the snapshot", name)
+}
+
+// principal finds the vertex for a member given as user:<email>, group:<email>,
+// serviceAccount:<email>, domain:<name>, customer:<id> or just an email (looked up as
+// a user, service account and group).
+func (x *graphIndex) principal(name string) (*Vertex, error) {
+	candidates := []*Vertex{userVertex(name), serviceAccountVertex(name), groupVertex(name)}
+	if strings.HasPrefix(name, "customer:") {
+		candidates = []*Vertex{customerVertex(strings.TrimPrefix(name, "customer:"))}
+	} else if v, ok := memberVertex(name); ok {
+		candidates = []*Vertex{v}
+	}
+	for _, v := range candidates {
+		if found, ok := x.vertex(v.ID()); ok {
+			return found, nil
+		}
+	}
+	return nil, fmt.Errorf("%s is not in the snapshot", name)
+}
+
+// ancestors returns the resource followed by the resources it inherits policies from
+// (bucket -> project -> folders -> organization).
+func (x *graphIndex) ancestors(v *Vertex) []*Vertex {
+	chain := []*Vertex{v}
+	seen := map[string]bool{v.ID(): true}
+	for i := 0; i < len(chain); i++ {
+		for _, e := range x.out[chain[i].ID()] {
+			if !isResource(e.To.Label) || seen[e.To.ID()] {
+				continue
+			}
+			seen[e.To.ID()] = true
+			chain = append(chain, e.To)
+		}
+	}
+	return chain
+}
+
+// descendants returns the resource followed by the resources that inherit its policy
+// (organization -> folders -> projects -> buckets).
+func (x *graphIndex) descendants(v *Vertex) []*Vertex {
+	tree := []*Vertex{v}
+	seen := map[string]bool{v.ID(): true}
+	for i := 0; i < len(tree); i++ {
+		for _, e := range x.in[tree[i].ID()] {
+			if !isResource(e.From.Label) || seen[e.From.ID()] {
+				continue
+			}
+			seen[e.From.ID()] = true
+			tree = append(tree, e.From)
+		}
+	}
+	return tree
+}
+
+// isPrincipal tells the vertices that can be members of a binding.
+func isPrincipal(label string) bool {
+	switch label {
+	case "user", "group", "serviceAccount", "domain", "customer":
+		return true
+	}
+	return false
+}
+
+// isPrincipalSet tells the principals that stand for their members.
+func isPrincipalSet(label string) bool {
+	return label == "group" || label == "domain" || label == "customer"
+}
+
+func isResource(label string) bool {
+	switch label {
+	case "bucket", "project", "folder", "organization":
+		return true
+	}
+	return false
+}
+
+// rolesWith returns the roles that include the permission (or just the role, if a role
+// is given instead of a permission).
+func (x *graphIndex) rolesWith(permissionOrRole string) (map[string]bool, error) {
+	if isRole(permissionOrRole) {
+		return map[string]bool{permissionOrRole: true}, nil
+	}
+	roles := make(map[string]bool)
+	for _, e := range x.out[permissionVertex(permissionOrRole).ID()] {
+		if e.To.Label == "role" {
+			roles[fmt.Sprint(e.To.Key[0].Value)] = true
+		}
+	}
+	if len(roles) == 0 {
+		return nil, fmt.Errorf("no role has %s (was the snapshot crawled with --includePermissions?)", permissionOrRole)
+	}
+	return roles, nil
+}
+
+// permissionsOf returns the permissions of the role, if the snapshot has them.
+func (x *graphIndex) permissionsOf(role string) []string {
+	var permissions []string
+	for _, e := range x.in[roleVertex(role).ID()] {
+		if e.From.Label == "permission" {
+			permissions = append(permissions, fmt.Sprint(e.From.Key[0].Value))
+		}
+	}
+	sort.Strings(permissions)
+	return permissions
+}
+
+func isRole(name string) bool {
+	return strings.HasPrefix(name, "roles/") || isCustomRole(name)
+}
+
+// bindingsOn returns the bindings of the resource's own policy.
+func (x *graphIndex) bindingsOn(resource *Vertex) []*Vertex {
+	var bindings []*Vertex
+	for _, e := range x.in[resource.ID()] {
+		if e.From.Label == "binding" {
+			bindings = append(bindings, e.From)
+		}
+	}
+	return bindings
+}
+
+// members walks from a binding (or group) down to every principal in it through
+// nested groups, calling fn with the path from the principal up to the binding.
+// A group that contains itself is only walked once per path.  The project binding
+// a bucket's projectOwner: (or editor, viewer) member stands for is walked like a group.
+func (x *graphIndex) members(v *Vertex, fn func(path []*Vertex)) {
+	var walk func(path []*Vertex)
+	walk = func(path []*Vertex) {
+		top := path[0]
+		for _, e := range x.in[top.ID()] {
+			m := e.From
+			if isResource(m.Label) || m.Label == "permission" {
+				continue
+			}
+			cycle := false
+			for _, p := range path {
+				if p.ID() == m.ID() {
+					cycle = true
+				}
+			}
+			if cycle {
+				continue
+			}
+			p := append([]*Vertex{m}, path...)
+			if m.Label != "binding" {
+				fn(p)
+			}
+			walk(p)
+		}
+	}
+	walk([]*Vertex{v})
+}
+
+// bindingsOf walks from a principal up through the groups it is in to every binding
+// it is a member of, calling fn with the path from the principal up to the binding;
+// and on from a project binding to the bucket bindings it is a member of.
+func (x *graphIndex) bindingsOf(v *Vertex, fn func(path []*Vertex)) {
+	var walk func(path []*Vertex)
+	walk = func(path []*Vertex) {
+		top := path[len(path)-1]
+		for _, e := range x.out[top.ID()] {
+			m := e.To
+			if !isPrincipalSet(m.Label) && m.Label != "binding" {
+				continue
+			}
+			cycle := false
+			for _, p := range path {
+				if p.ID() == m.ID() {
+					cycle = true
+				}
+			}
+			if cycle {
+				continue
+			}
+			p := append(append([]*Vertex{}, path...), m)
+			if m.Label == "binding" {
+				fn(p)
+			}
+			walk(p)
+		}
+	}
+	walk([]*Vertex{v})
+}
+
+// membershipRole is the member's role in the group (OWNER, MANAGER or MEMBER), "" if
+// the snapshot doesn't have it.
+func (x *graphIndex) membershipRole(member, group *Vertex) string {
+	x.g.mu.Lock()
+	defer x.g.mu.Unlock()
+	if e, ok := x.g.edges[inEdge(member, group).ID()]; ok {
+		for _, p := range e.Properties {
+			if p.Key == "role" {
+				return fmt.Sprint(p.Value)
+			}
+		}
+	}
+	return ""
+}
+
+func isManager(role string) bool {
+	return role == "OWNER" || role == "MANAGER"
+}
+
+// manages returns the group a path (from a principal up to a binding) starts through
+// if the principal is an owner or manager of it: it can add anyone to the group, so it
+// can hand out the access too.  "" unless escalation is on.
+func (x *graphIndex) manages(path []*Vertex) string {
+	if !x.escalation || len(path) < 2 || path[1].Label != "group" {
+		return ""
+	}
+	if isManager(x.membershipRole(path[0], path[1])) {
+		return path[1].ID()
+	}
+	return ""
+}
+
+// accessGrant is one way a principal gets a role on a resource.
+type accessGrant struct {
+	Principal string   `json:"principal"`
+	Role      string   `json:"role"`
+	Resource  string   `json:"resource"`
+	GrantedOn string   `json:"grantedOn"`
+	Condition string   `json:"condition,omitempty"`
+	Path      []string `json:"path"`
+	// Manages is the group the principal owns or manages on the path (see --escalation)
+	Manages string `json:"manages,omitempty"`
+	// Permissions are the role's permissions, for what-can --permissions
+	Permissions []string `json:"permissions,omitempty"`
+}
+
+// whoCan returns every principal that holds one of the roles on the resource, directly,
+// through nested groups or through a binding on a folder or organization above it.
+func (x *graphIndex) whoCan(roles map[string]bool, resource *Vertex) []accessGrant {
+	var grants []accessGrant
+	for _, r := range x.ancestors(resource) {
+		for _, b := range x.bindingsOn(r) {
+			role := stringProperty(b, "role")
+			if !roles[role] {
+				continue
+			}
+			x.members(b, func(path []*Vertex) {
+				ids := make([]string, 0, len(path)+1)
+				for _, v := range path {
+					ids = append(ids, v.ID())
+				}
+				grants = append(grants, accessGrant{
+					Principal: path[0].ID(),
+					Role:      role,
+					Resource:  resource.ID(),
+					GrantedOn: r.ID(),
+					Condition: stringProperty(b, "condition"),
+					Path:      append(ids, r.ID()),
+					Manages:   x.manages(path),
+				})
+			})
+		}
+	}
+	sort.SliceStable(grants, func(i, j int) bool { return grants[i].Principal < grants[j].Principal })
+	return grants
+}
+
+// whatCan returns every role the principal holds on every resource, directly or through
+// nested groups, on the resource the binding is on and on all the resources below it.
+func (x *graphIndex) whatCan(principal *Vertex) []accessGrant {
+	var grants []accessGrant
+	x.bindingsOf(principal, func(path []*Vertex) {
+		b := path[len(path)-1]
+		var on *Vertex
+		for _, e := range x.out[b.ID()] {
+			if isResource(e.To.Label) {
+				on = e.To
+			}
+		}
+		if on == nil {
+			return
+		}
+		ids := make([]string, 0, len(path)+1)
+		for _, v := range path {
+			ids = append(ids, v.ID())
+		}
+		ids = append(ids, on.ID())
+		for _, r := range x.descendants(on) {
+			grants = append(grants, accessGrant{
+				Principal: principal.ID(),
+				Role:      stringProperty(b, "role"),
+				Resource:  r.ID(),
+				GrantedOn: on.ID(),
+				Condition: stringProperty(b, "condition"),
+				Path:      ids,
+				Manages:   x.manages(path),
+			})
+		}
+	})
+	sort.SliceStable(grants, func(i, j int) bool {
+		if grants[i].Resource != grants[j].Resource {
+			return grants[i].Resource < grants[j].Resource
+		}
+		return grants[i].Role < grants[j].Role
+	})
+	return grants
+}
+
+// loadIndex reads the snapshot the query commands run on.
+func loadIndex(path string) (*graphIndex, error) {
+	if path == "" {
+		return nil, fmt.Errorf("no snapshot, use --snapshot (see --snapshotFile)")
+	}
+	_, g, err := loadSnapshot(path)
+	if err != nil {
+		return nil, err
+	}
+	return newGraphIndex(g), nil
+}
+
+// runWhoCan is the who-can command: who holds a permission or role on a resource.
+func runWhoCan(args []string) error {
+	fs := newQueryFlags("who-can", "<permission|role> <projects/ID|buckets/NAME|folders/ID|organizations/ID>", "text", "json")
+	if err := fs.parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return fmt.Errorf("who-can needs a permission or role and a resource")
+	}
+
+	x, err := fs.index()
+	if err != nil {
+		return err
+	}
+	roles, err := x.rolesWith(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	resource, err := x.resource(fs.Arg(1))
+	if err != nil {
+		return err
+	}
+	grants := x.whoCan(roles, resource)
+
+	return fs.write(func(w io.Writer) error {
+		if *fs.format == "json" {
+			if grants == nil {
+				grants = []accessGrant{}
+			}
+			return writeJSON(w, grants)
+		}
+		if len(grants) == 0 {
+			fmt.Fprintf(w, "nobody has %s on %s\n", fs.Arg(0), resource.ID())
+		}
+		for _, g := range grants {
+			fmt.Fprintf(w, "%s has %s on %s", g.Principal, g.Role, g.GrantedOn)
+			if g.GrantedOn != g.Resource {
+				fmt.Fprintf(w, " (inherited by %s)", g.Resource)
+			}
+			if g.Condition != "" {
+				fmt.Fprintf(w, " if %s", g.Condition)
+			}
+			if g.Manages != "" {
+				fmt.Fprintf(w, " and can grant it by adding members to %s", g.Manages)
+			}
+			fmt.Fprintf(w, "\n    %s\n", strings.Join(g.Path, " -in-> "))
+		}
+		return nil
+	})
+}
+
+// runWhatCan is the what-can command: every role (and, with --permissions, permission)
+// a principal has on every resource.
+func runWhatCan(args []string) error {
+	fs := newQueryFlags("what-can", "<email|user:EMAIL|group:EMAIL|serviceAccount:EMAIL>", "table", "json", "csv")
+	withPermissions := fs.Bool("permissions", false, "list the permissions of each role (the snapshot must be crawled with --includePermissions)")
+	if err := fs.parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return fmt.Errorf("what-can needs a principal")
+	}
+
+	x, err := fs.index()
+	if err != nil {
+		return err
+	}
+	principal, err := x.principal(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	grants := x.whatCan(principal)
+	if *withPermissions {
+		for i := range grants {
+			grants[i].Permissions = x.permissionsOf(grants[i].Role)
+		}
+	}
+
+	return fs.write(func(w io.Writer) error {
+		switch *fs.format {
+		case "json":
+			if grants == nil {
+				grants = []accessGrant{}
+			}
+			return writeJSON(w, grants)
+		case "csv":
+			cw := csv.NewWriter(w)
+			header := []string{"principal", "resource", "role", "grantedOn", "condition", "path"}
+			if *fs.escalation {
+				header = append(header, "manages")
+			}
+			if *withPermissions {
+				header = append(header, "permissions")
+			}
+			cw.Write(header)
+			for _, g := range grants {
+				row := []string{g.Principal, g.Resource, g.Role, g.GrantedOn, g.Condition, strings.Join(g.Path, " -in-> ")}
+				if *fs.escalation {
+					row = append(row, g.Manages)
+				}
+				if *withPermissions {
+					row = append(row, strings.Join(g.Permissions, " "))
+				}
+				cw.Write(row)
+			}
+			cw.Flush()
+			return cw.Error()
+		}
+		if len(grants) == 0 {
+			fmt.Fprintf(w, "%s has no roles\n", principal.ID())
+			return nil
+		}
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		columns := []string{"RESOURCE", "ROLE", "GRANTED ON", "CONDITION", "PATH"}
+		if *fs.escalation {
+			columns = append(columns, "MANAGES")
+		}
+		fmt.Fprintln(tw, strings.Join(columns, "\t"))
+		for _, g := range grants {
+			row := []string{g.Resource, g.Role, g.GrantedOn, g.Condition, strings.Join(g.Path, " -in-> ")}
+			if *fs.escalation {
+				row = append(row, g.Manages)
+			}
+			fmt.Fprintln(tw, strings.Join(row, "\t"))
+			for _, p := range g.Permissions {
+				fmt.Fprintf(tw, "\t  %s%s\n", p, strings.Repeat("\t", len(columns)-2))
+			}
+		}
+		return tw.Flush()
+	})
+}
@@ -0,0 +1,328 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"google.golang.org/api/cloudresourcemanager/v1"
+)
+
+const testCondition = `request.time < timestamp("2030-01-01T00:00:00Z")`
+
+// testGraph builds a small organization the way the collectors do:
+//
+//	organizations/1 <- folders/2 <- project p1 <- bucket b1
+//	organizations/1 <- project p2
+//
+// alice (OWNER) and dave (external) are in eng, which is in team; loop-a and loop-b
+// are members of each other and carol is in loop-b; the account C1 (domain
+// example.com) is in everyone.
+func testGraph() *graph {
+	defer func(g *graph) { orgGraph = g }(orgGraph)
+	orgGraph = newGraph()
+
+	org, folder := organizationVertex("organizations/1"), folderVertex("folders/2")
+	p1, p2, b1 := projectVertex("p1"), projectVertex("p2"), bucketVertex("b1")
+	upsertEdge(inEdge(folder, org))
+	upsertEdge(inEdge(p1, folder))
+	upsertEdge(inEdge(p2, org))
+	upsertEdge(inEdge(b1, p1))
+
+	for _, u := range []string{"alice@example.com", "bob@example.com", "carol@example.com"} {
+		upsertVertex(userVertex(u).set("isExternal", false))
+	}
+	upsertVertex(userVertex("dave@other.com").set("isExternal", true))
+	upsertVertex(customerVertex("C1").set("isExternal", false))
+	upsertEdge(inEdge(domainVertex("example.com"), customerVertex("C1")))
+
+	member := func(m *Vertex, group, role string) {
+		upsertEdge(inEdge(m, groupVertex(group)).set("role", role))
+	}
+	member(userVertex("alice@example.com"), "eng@example.com", "OWNER")
+	member(userVertex("dave@other.com"), "eng@example.com", "MEMBER")
+	member(groupVertex("eng@example.com"), "team@example.com", "MEMBER")
+	member(groupVertex("loop-b@example.com"), "loop-a@example.com", "MEMBER")
+	member(groupVertex("loop-a@example.com"), "loop-b@example.com", "MEMBER")
+	member(userVertex("carol@example.com"), "loop-b@example.com", "MEMBER")
+	member(customerVertex("C1"), "everyone@example.com", "MEMBER")
+
+	addBindings(org, []*cloudresourcemanager.Binding{
+		{Role: "roles/viewer", Members: []string{"group:team@example.com"}},
+	})
+	addBindings(folder, []*cloudresourcemanager.Binding{
+		{Role: "roles/browser", Members: []string{"group:loop-a@example.com"}},
+	})
+	addBindings(p1, []*cloudresourcemanager.Binding{
+		{Role: "roles/owner", Members: []string{"user:bob@example.com"}},
+		{Role: "roles/editor", Members: []string{"user:dave@other.com"},
+			Condition: &cloudresourcemanager.Expr{Expression: testCondition, Title: "until 2030"}},
+	})
+	addBindings(b1, []*cloudresourcemanager.Binding{
+		{Role: "roles/storage.objectViewer", Members: []string{"projectOwner:p1", "deleted:user:gone@example.com?uid=1"}},
+	})
+	addBindings(p2, []*cloudresourcemanager.Binding{
+		{Role: "roles/browser", Members: []string{"domain:example.com"}},
+		{Role: "roles/logging.viewer", Members: []string{"group:everyone@example.com"}},
+	})
+	return orgGraph
+}
+
+// grantStrings renders grants as "[resource:] path [if condition] [manages group]".
+func grantStrings(grants []accessGrant) []string {
+	s := make([]string, 0, len(grants))
+	for _, g := range grants {
+		r := strings.Join(g.Path, " ")
+		if g.Resource != g.GrantedOn {
+			r = g.Resource + ": " + r
+		}
+		if g.Condition != "" {
+			r += " if " + g.Condition
+		}
+		if g.Manages != "" {
+			r += " manages " + g.Manages
+		}
+		s = append(s, r)
+	}
+	return s
+}
+
+// checkStrings compares got and want in any order.
+func checkStrings(t *testing.T, name string, got, want []string) {
+	t.Helper()
+	sort.Strings(got)
+	sort.Strings(want)
+	if len(got) == 0 && len(want) == 0 {
+		return
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("%s:\ngot\n\t%s\nwant\n\t%s", name, strings.Join(got, "\n\t"), strings.Join(want, "\n\t"))
+	}
+}
+
+const (
+	orgViewer    = "binding:organization:organizations/1/roles/viewer organization:organizations/1"
+	folderBrowse = "binding:folder:folders/2/roles/browser folder:folders/2"
+	p1Owner      = "binding:project:p1/roles/owner"
+	b1Viewer     = "binding:bucket:b1/roles/storage.objectViewer bucket:b1"
+	p2Browser    = "binding:project:p2/roles/browser project:p2"
+	p2Logging    = "binding:project:p2/roles/logging.viewer project:p2"
+)
+
+func TestWhoCan(t *testing.T) {
+	x := newGraphIndex(testGraph())
+	for _, tc := range []struct {
+		role, resource string
+		want           []string
+	}{
+		{
+			// nested groups, inherited from the organization down to a bucket
+			"roles/viewer", "buckets/b1", []string{
+				"bucket:b1: group:team@example.com " + orgViewer,
+				"bucket:b1: group:eng@example.com group:team@example.com " + orgViewer,
+				"bucket:b1: user:alice@example.com group:eng@example.com group:team@example.com " + orgViewer,
+				"bucket:b1: user:dave@other.com group:eng@example.com group:team@example.com " + orgViewer,
+			},
+		},
+		{
+			// a group cycle is walked once per path
+			"roles/browser", "projects/p1", []string{
+				"project:p1: group:loop-a@example.com " + folderBrowse,
+				"project:p1: group:loop-b@example.com group:loop-a@example.com " + folderBrowse,
+				"project:p1: user:carol@example.com group:loop-b@example.com group:loop-a@example.com " + folderBrowse,
+			},
+		},
+		{
+			// projectOwner:p1 is the project's owners; the deleted member is not there
+			"roles/storage.objectViewer", "buckets/b1", []string{
+				"user:bob@example.com " + p1Owner + " " + b1Viewer,
+			},
+		},
+		{
+			"roles/owner", "buckets/b1", []string{
+				"bucket:b1: user:bob@example.com " + p1Owner + " project:p1",
+			},
+		},
+		{
+			"roles/editor", "projects/p1", []string{
+				"user:dave@other.com binding:project:p1/roles/editor?" + conditionHash(testCondition) + " project:p1 if " + testCondition,
+			},
+		},
+		{
+			// the users of a domain
+			"roles/browser", "projects/p2", []string{
+				"domain:example.com " + p2Browser,
+				"user:alice@example.com domain:example.com " + p2Browser,
+				"user:bob@example.com domain:example.com " + p2Browser,
+				"user:carol@example.com domain:example.com " + p2Browser,
+			},
+		},
+		{
+			// the users of the account, through its domains
+			"roles/logging.viewer", "projects/p2", []string{
+				"group:everyone@example.com " + p2Logging,
+				"customer:C1 group:everyone@example.com " + p2Logging,
+				"domain:example.com customer:C1 group:everyone@example.com " + p2Logging,
+				"user:alice@example.com domain:example.com customer:C1 group:everyone@example.com " + p2Logging,
+				"user:bob@example.com domain:example.com customer:C1 group:everyone@example.com " + p2Logging,
+				"user:carol@example.com domain:example.com customer:C1 group:everyone@example.com " + p2Logging,
+			},
+		},
+		{"roles/owner", "projects/p2", nil},
+	} {
+		resource, err := x.resource(tc.resource)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := grantStrings(x.whoCan(map[string]bool{tc.role: true}, resource))
+		checkStrings(t, tc.role+" on "+tc.resource, got, tc.want)
+	}
+}
+
+func TestWhatCan(t *testing.T) {
+	x := newGraphIndex(testGraph())
+	everyone := func(user string) []string {
+		return []string{
+			user + " domain:example.com " + p2Browser,
+			user + " domain:example.com customer:C1 group:everyone@example.com " + p2Logging,
+		}
+	}
+	for _, tc := range []struct {
+		principal string
+		want      []string
+	}{
+		{
+			"alice@example.com", append(everyone("user:alice@example.com"),
+				"user:alice@example.com group:eng@example.com group:team@example.com "+orgViewer,
+				"folder:folders/2: user:alice@example.com group:eng@example.com group:team@example.com "+orgViewer,
+				"project:p1: user:alice@example.com group:eng@example.com group:team@example.com "+orgViewer,
+				"project:p2: user:alice@example.com group:eng@example.com group:team@example.com "+orgViewer,
+				"bucket:b1: user:alice@example.com group:eng@example.com group:team@example.com "+orgViewer,
+			),
+		},
+		{
+			"user:bob@example.com", append(everyone("user:bob@example.com"),
+				"user:bob@example.com "+p1Owner+" project:p1",
+				"bucket:b1: user:bob@example.com "+p1Owner+" project:p1",
+				"user:bob@example.com "+p1Owner+" "+b1Viewer,
+			),
+		},
+		{
+			"carol@example.com", append(everyone("user:carol@example.com"),
+				"user:carol@example.com group:loop-b@example.com group:loop-a@example.com "+folderBrowse,
+				"project:p1: user:carol@example.com group:loop-b@example.com group:loop-a@example.com "+folderBrowse,
+				"bucket:b1: user:carol@example.com group:loop-b@example.com group:loop-a@example.com "+folderBrowse,
+			),
+		},
+		{
+			"group:loop-a@example.com", []string{
+				"group:loop-a@example.com " + folderBrowse,
+				"project:p1: group:loop-a@example.com " + folderBrowse,
+				"bucket:b1: group:loop-a@example.com " + folderBrowse,
+			},
+		},
+		{
+			"customer:C1", []string{
+				"customer:C1 group:everyone@example.com " + p2Logging,
+			},
+		},
+	} {
+		principal, err := x.principal(tc.principal)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkStrings(t, tc.principal, grantStrings(x.whatCan(principal)), tc.want)
+	}
+}
+
+func TestDeletedMembers(t *testing.T) {
+	g := testGraph()
+	for id := range g.vertices {
+		if strings.Contains(id, "gone@example.com") {
+			t.Errorf("deleted member is in the graph as %s", id)
+		}
+	}
+}
+
+// An owner or manager of a group can hand its access out, a member can't.
+func TestEscalation(t *testing.T) {
+	x := newGraphIndex(testGraph())
+	org, err := x.resource("organizations/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	viewer := map[string]bool{"roles/viewer": true}
+	for _, escalation := range []bool{false, true} {
+		x.escalation = escalation
+		manages := make(map[string]string)
+		for _, g := range x.whoCan(viewer, org) {
+			manages[g.Principal] = g.Manages
+		}
+		want := map[string]string{
+			"group:team@example.com": "",
+			"group:eng@example.com":  "",
+			"user:alice@example.com": "",
+			"user:dave@other.com":    "",
+		}
+		if escalation {
+			want["user:alice@example.com"] = "group:eng@example.com"
+		}
+		if !reflect.DeepEqual(manages, want) {
+			t.Errorf("escalation %v: who-can manages %v, want %v", escalation, manages, want)
+		}
+
+		alice, _ := x.principal("alice@example.com")
+		for _, g := range x.whatCan(alice) {
+			want := ""
+			if escalation && g.Role == "roles/viewer" {
+				want = "group:eng@example.com"
+			}
+			if g.Manages != want {
+				t.Errorf("escalation %v: what-can %s on %s manages %q, want %q", escalation, g.Role, g.Resource, g.Manages, want)
+			}
+		}
+	}
+}
+
+// Without its domains, the account stands for the users listed from the Directory.
+func TestCustomerWithoutDomains(t *testing.T) {
+	defer func(g *graph) { orgGraph = g }(orgGraph)
+	orgGraph = newGraph()
+	upsertVertex(userVertex("in@example.com").set("isExternal", false))
+	upsertVertex(userVertex("out@other.com").set("isExternal", true))
+	upsertVertex(userVertex("unknown@example.com"))
+	upsertEdge(inEdge(customerVertex("C2"), groupVertex("staff@example.com")).set("role", "MEMBER"))
+	p := projectVertex("p")
+	addBindings(p, []*cloudresourcemanager.Binding{{Role: "roles/viewer", Members: []string{"group:staff@example.com"}}})
+	x := newGraphIndex(orgGraph)
+
+	got := grantStrings(x.whoCan(map[string]bool{"roles/viewer": true}, p))
+	checkStrings(t, "roles/viewer", got, []string{
+		"group:staff@example.com binding:project:p/roles/viewer project:p",
+		"customer:C2 group:staff@example.com binding:project:p/roles/viewer project:p",
+		"user:in@example.com customer:C2 group:staff@example.com binding:project:p/roles/viewer project:p",
+	})
+}
+
+// conditionHash is the suffix bindingVertex gives a conditional binding.
+func conditionHash(expression string) string {
+	v := bindingVertex(projectVertex("p"), "r", &cloudresourcemanager.Expr{Expression: expression})
+	name := fmt.Sprint(v.Key[0].Value)
+	return name[strings.Index(name, "?")+1:]
+}
@@ -0,0 +1,345 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	changeAdded   = "added"
+	changeRemoved = "removed"
+	changeChanged = "changed"
+)
+
+// accessReport is what changed in access between two snapshots, for an access review.
+type accessReport struct {
+	From               time.Time          `json:"from"`
+	To                 time.Time          `json:"to"`
+	UsersAdded         []string           `json:"usersAdded"`
+	UsersRemoved       []string           `json:"usersRemoved"`
+	GroupsAdded        []string           `json:"groupsAdded"`
+	GroupsRemoved      []string           `json:"groupsRemoved"`
+	Memberships        []membershipChange `json:"memberships"`
+	Grants             []grantChange      `json:"grants"`
+	CustomRolesAdded   []string           `json:"customRolesAdded"`
+	CustomRolesRemoved []string           `json:"customRolesRemoved"`
+	Permissions        []permissionChange `json:"permissions"`
+}
+
+// membershipChange is a member (user:, group:...) added to or removed from a group, or
+// whose role in the group (OWNER, MANAGER or MEMBER) changed from OldRole.
+type membershipChange struct {
+	Change  string `json:"change"`
+	Member  string `json:"member"`
+	Group   string `json:"group"`
+	Role    string `json:"role,omitempty"`
+	OldRole string `json:"oldRole,omitempty"`
+}
+
+// grantChange is a member added to or removed from an IAM binding.
+type grantChange struct {
+	Change    string `json:"change"`
+	Member    string `json:"member"`
+	Role      string `json:"role"`
+	Resource  string `json:"resource"`
+	Condition string `json:"condition,omitempty"`
+}
+
+// permissionChange is a permission added to or removed from a role.
+type permissionChange struct {
+	Change     string `json:"change"`
+	Role       string `json:"role"`
+	Permission string `json:"permission"`
+}
+
+// newAccessReport sorts the changes between the graphs of two snapshots into the
+// report's sections.
+func newAccessReport(from, to *snapshot, old, cur *graph) *accessReport {
+	r := &accessReport{
+		From:               from.Saved,
+		To:                 to.Saved,
+		UsersAdded:         []string{},
+		UsersRemoved:       []string{},
+		GroupsAdded:        []string{},
+		GroupsRemoved:      []string{},
+		Memberships:        []membershipChange{},
+		Grants:             []grantChange{},
+		CustomRolesAdded:   []string{},
+		CustomRolesRemoved: []string{},
+		Permissions:        []permissionChange{},
+	}
+	d := diffGraphs(old, cur)
+
+	for _, c := range d.vertices {
+		if c.old != nil && c.v != nil {
+			continue
+		}
+		v, change := c.v, changeAdded
+		if v == nil {
+			v, change = c.old, changeRemoved
+		}
+		name := fmt.Sprint(v.Key[0].Value)
+		switch {
+		case v.Label == "user":
+			r.UsersAdded, r.UsersRemoved = appendChange(r.UsersAdded, r.UsersRemoved, change, name)
+		case v.Label == "group":
+			r.GroupsAdded, r.GroupsRemoved = appendChange(r.GroupsAdded, r.GroupsRemoved, change, name)
+		case v.Label == "role" && isCustomRole(name):
+			r.CustomRolesAdded, r.CustomRolesRemoved = appendChange(r.CustomRolesAdded, r.CustomRolesRemoved, change, name)
+		}
+	}
+
+	for _, c := range d.edges {
+		if c.old != nil && c.e != nil {
+			if c.e.Label == "in" && c.e.To.Label == "group" {
+				// a snapshot taken before roles were recorded has none
+				if was, is := edgeRole(c.old), edgeRole(c.e); was != "" && was != is {
+					r.Memberships = append(r.Memberships, membershipChange{changeChanged, c.e.From.ID(), fmt.Sprint(c.e.To.Key[0].Value), is, was})
+				}
+			}
+			continue
+		}
+		e, change := c.e, changeAdded
+		if e == nil {
+			e, change = c.old, changeRemoved
+		}
+		if e.Label != "in" {
+			continue
+		}
+		switch {
+		case e.To.Label == "group":
+			r.Memberships = append(r.Memberships, membershipChange{change, e.From.ID(), fmt.Sprint(e.To.Key[0].Value), edgeRole(e), ""})
+		case e.To.Label == "binding":
+			r.Grants = append(r.Grants, grantChange{
+				Change:    change,
+				Member:    e.From.ID(),
+				Role:      stringProperty(e.To, "role"),
+				Resource:  stringProperty(e.To, "resource"),
+				Condition: stringProperty(e.To, "condition"),
+			})
+		case e.From.Label == "permission" && e.To.Label == "role":
+			r.Permissions = append(r.Permissions, permissionChange{change, fmt.Sprint(e.To.Key[0].Value), fmt.Sprint(e.From.Key[0].Value)})
+		}
+	}
+	return r
+}
+
+func appendChange(added, removed []string, change, name string) ([]string, []string) {
+	if change == changeAdded {
+		return append(added, name), removed
+	}
+	return added, append(removed, name)
+}
+
+// isCustomRole tells the roles defined in a project or organization from the predefined roles/...
+func isCustomRole(name string) bool {
+	return strings.HasPrefix(name, "projects/") || strings.HasPrefix(name, "organizations/")
+}
+
+func stringProperty(v *Vertex, key string) string {
+	if i := findProperty(v.Properties, key); i >= 0 {
+		return fmt.Sprint(v.Properties[i].Value)
+	}
+	return ""
+}
+
+// edgeRole is the member's role on a membership edge.
+func edgeRole(e *Edge) string {
+	if i := findProperty(e.Properties, "role"); i >= 0 {
+		return fmt.Sprint(e.Properties[i].Value)
+	}
+	return ""
+}
+
+func (r *accessReport) writeText(w io.Writer) {
+	fmt.Fprintf(w, "Access changes from %v to %v\n", r.From.Format(time.RFC3339), r.To.Format(time.RFC3339))
+
+	names := func(title string, added, removed []string) {
+		if len(added)+len(removed) == 0 {
+			return
+		}
+		fmt.Fprintf(w, "\n%s (%d added, %d removed)\n", title, len(added), len(removed))
+		for _, n := range added {
+			fmt.Fprintf(w, "  + %s\n", n)
+		}
+		for _, n := range removed {
+			fmt.Fprintf(w, "  - %s\n", n)
+		}
+	}
+	sign := func(change string) string {
+		switch change {
+		case changeAdded:
+			return "+"
+		case changeChanged:
+			return "~"
+		}
+		return "-"
+	}
+
+	names("Users", r.UsersAdded, r.UsersRemoved)
+	names("Groups", r.GroupsAdded, r.GroupsRemoved)
+	if len(r.Memberships) > 0 {
+		fmt.Fprintf(w, "\nGroup memberships (%d)\n", len(r.Memberships))
+		for _, m := range r.Memberships {
+			fmt.Fprintf(w, "  %s %s in %s", sign(m.Change), m.Member, m.Group)
+			switch {
+			case m.OldRole != "":
+				fmt.Fprintf(w, " (%s, was %s)", m.Role, m.OldRole)
+			case m.Role != "" && m.Role != "MEMBER":
+				fmt.Fprintf(w, " (%s)", m.Role)
+			}
+			fmt.Fprintln(w)
+		}
+	}
+	if len(r.Grants) > 0 {
+		fmt.Fprintf(w, "\nIAM grants (%d)\n", len(r.Grants))
+		for _, g := range r.Grants {
+			fmt.Fprintf(w, "  %s %s has %s on %s", sign(g.Change), g.Member, g.Role, g.Resource)
+			if g.Condition != "" {
+				fmt.Fprintf(w, " if %s", g.Condition)
+			}
+			fmt.Fprintln(w)
+		}
+	}
+	names("Custom roles", r.CustomRolesAdded, r.CustomRolesRemoved)
+	if len(r.Permissions) > 0 {
+		fmt.Fprintf(w, "\nRole permissions (%d)\n", len(r.Permissions))
+		for _, p := range r.Permissions {
+			fmt.Fprintf(w, "  %s %s: %s\n", sign(p.Change), p.Role, p.Permission)
+		}
+	}
+}
+
+// runDiff is the diff command: it compares two snapshots (see --snapshotFile) and
+// prints the access changes between them.
+func runDiff(args []string) error {
+	fs := newCommandFlags("diff", "old.snapshot.json new.snapshot.json", "text", "json")
+	if err := fs.parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return fmt.Errorf("diff needs two snapshots")
+	}
+
+	from, old, err := loadSnapshot(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	to, cur, err := loadSnapshot(fs.Arg(1))
+	if err != nil {
+		return err
+	}
+	r := newAccessReport(from, to, old, cur)
+
+	return fs.write(func(w io.Writer) error {
+		if *fs.format == "json" {
+			return writeJSON(w, r)
+		}
+		r.writeText(w)
+		return nil
+	})
+}
+
+// commandFlags are the flags every command has: --format and --out.
+type commandFlags struct {
+	*flag.FlagSet
+	format  *string
+	formats []string
+	out     *string
+}
+
+// newCommandFlags starts the flags of a command (usage describes its arguments) that
+// writes its output in one of formats, the first is the default.
+func newCommandFlags(name, usage string, formats ...string) *commandFlags {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	c := &commandFlags{FlagSet: fs, formats: formats}
+	c.format = fs.String("format", formats[0], "output format: "+strings.Join(formats, "|"))
+	c.out = fs.String("out", "", "write the result to this file instead of stdout")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s %s [flags] %s\n", os.Args[0], name, usage)
+		fs.PrintDefaults()
+	}
+	return c
+}
+
+// parse parses the command's arguments and checks --format.
+func (c *commandFlags) parse(args []string) error {
+	c.Parse(args)
+	if _, ok := find(c.formats, *c.format); !ok {
+		return fmt.Errorf("unknown format %q", *c.format)
+	}
+	return nil
+}
+
+// write runs write on --out, or on stdout.
+func (c *commandFlags) write(write func(w io.Writer) error) error {
+	return writeOutput(*c.out, write)
+}
+
+// queryFlags are the flags of the commands that query a snapshot.
+type queryFlags struct {
+	*commandFlags
+	snapshot   *string
+	escalation *bool
+}
+
+func newQueryFlags(name, usage string, formats ...string) *queryFlags {
+	q := &queryFlags{commandFlags: newCommandFlags(name, usage, formats...)}
+	q.snapshot = q.String("snapshot", *snapshotFile, "snapshot to query (see --snapshotFile)")
+	q.escalation = q.Bool("escalation", false, "treat being a group OWNER or MANAGER as a way to grant the group's access to others")
+	return q
+}
+
+// index loads the snapshot to query.
+func (q *queryFlags) index() (*graphIndex, error) {
+	x, err := loadIndex(*q.snapshot)
+	if err != nil {
+		return nil, err
+	}
+	x.escalation = *q.escalation
+	return x, nil
+}
+
+// writeJSON writes v as indented JSON, without escaping <, > and & (eg, in conditions).
+func writeJSON(w io.Writer, v interface{}) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.SetEscapeHTML(false)
+	return enc.Encode(v)
+}
+
+// writeOutput runs write on path, or on stdout if path is empty.
+func writeOutput(path string, write func(w io.Writer) error) error {
+	if path == "" {
+		return write(os.Stdout)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := write(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
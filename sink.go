@@ -0,0 +1,191 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+type Property struct {
+	Key   string
+	Value interface{}
+}
+
+// Vertex is identified by its label and the properties that make up its natural key
+// (eg, the email of a user); Properties holds everything else.
+type Vertex struct {
+	Label      string
+	Key        []Property
+	Properties []Property
+}
+
+// Edge connects two vertices; From and To only need their Label and Key set.
+type Edge struct {
+	Label      string
+	From       *Vertex
+	To         *Vertex
+	Properties []Property
+}
+
+func (v *Vertex) set(key string, value interface{}) *Vertex {
+	v.Properties = append(v.Properties, Property{key, value})
+	return v
+}
+
+func (e *Edge) set(key string, value interface{}) *Edge {
+	e.Properties = append(e.Properties, Property{key, value})
+	return e
+}
+
+func newVertex(label, key string, value interface{}) *Vertex {
+	return &Vertex{Label: label, Key: []Property{{key, value}}}
+}
+
+func userVertex(email string) *Vertex {
+	return newVertex("user", "email", email)
+}
+
+func groupVertex(email string) *Vertex {
+	return newVertex("group", "email", email)
+}
+
+// customerVertex is everyone in the Workspace account (a group member of type CUSTOMER).
+func customerVertex(id string) *Vertex {
+	return newVertex("customer", "customerId", id)
+}
+
+// domainVertex is everyone in a domain (an IAM member domain:example.com).
+func domainVertex(name string) *Vertex {
+	return newVertex("domain", "name", name)
+}
+
+func serviceAccountVertex(email string) *Vertex {
+	return newVertex("serviceAccount", "email", email)
+}
+
+func roleVertex(name string) *Vertex {
+	return newVertex("role", "name", name)
+}
+
+func permissionVertex(name string) *Vertex {
+	return newVertex("permission", "name", name)
+}
+
+func projectVertex(projectID string) *Vertex {
+	return newVertex("project", "projectid", projectID)
+}
+
+func bucketVertex(name string) *Vertex {
+	return newVertex("bucket", "name", name)
+}
+
+// inEdge is the only relationship used in the graph: from is 'in' to (a member is in a
+// group, a group is in a role, a role is in a project...)
+func inEdge(from, to *Vertex) *Edge {
+	return &Edge{
+		Label:      "in",
+		From:       from,
+		To:         to,
+		Properties: []Property{{"weight", 1}},
+	}
+}
+
+// Sink receives the graph once the collectors are done.  The file formats that are
+// rewritten on every run (graphml, graphson, neo4j) render it directly; the others
+// are sent one vertex or edge at a time (see streamGraph).
+type Sink interface {
+	WriteGraph(g *graph) error
+	Close() error
+}
+
+// ChangeSink is implemented by the sinks that take one vertex or edge at a time and
+// can apply the changes since the previous run (see --incremental) to a graph that was
+// loaded before: besides adding vertices and edges they can replace the properties of
+// existing ones (old has the properties loaded before) and remove them.  Sinks that
+// can't are sent the whole graph instead.  Implementations should be idempotent so
+// the output can be applied to a graph that was loaded before.
+type ChangeSink interface {
+	Sink
+	UpsertVertex(v *Vertex) error
+	UpsertEdge(e *Edge) error
+	Flush() error
+	UpdateVertex(old, v *Vertex) error
+	UpdateEdge(old, e *Edge) error
+	DropVertex(v *Vertex) error
+	DropEdge(e *Edge) error
+}
+
+// newSink opens every sink named in the comma separated list; more than one
+// sink fans the operations out to all of them.
+func newSink(names string) (Sink, error) {
+	var sinks multiSink
+	for _, name := range strings.Split(names, ",") {
+		var s Sink
+		var err error
+		switch strings.TrimSpace(name) {
+		case "groovy":
+			s = newGroovySink()
+		case "gremlin":
+			s, err = newGremlinSink(*gremlinURL, *gremlinUsername, *gremlinPassword, *gremlinBatchSize)
+		case "graphml":
+			s = newGraphMLSink(*graphmlFile)
+		case "graphson":
+			s = newGraphSONSink(*graphsonFile)
+		case "cypher":
+			s, err = newCypherSink(*cypherFile)
+		case "neo4j":
+			s = newNeo4jImportSink(*neo4jImportDir)
+		default:
+			err = fmt.Errorf("unknown sink %q", name)
+		}
+		if err != nil {
+			sinks.Close()
+			return nil, err
+		}
+		sinks = append(sinks, s)
+	}
+	if len(sinks) == 1 {
+		return sinks[0], nil
+	}
+	return sinks, nil
+}
+
+type multiSink []Sink
+
+func (m multiSink) WriteGraph(g *graph) error {
+	return m.each(func(s Sink) error { return s.WriteGraph(g) })
+}
+
+func (m multiSink) Close() error {
+	return m.each(Sink.Close)
+}
+
+// each applies fn to every sink, even if one of them fails, and returns the first error.
+func (m multiSink) each(fn func(Sink) error) error {
+	var first error
+	for _, s := range m {
+		if err := fn(s); err != nil {
+			if first == nil {
+				first = err
+			} else {
+				glog.Error(err)
+			}
+		}
+	}
+	return first
+}
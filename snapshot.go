@@ -0,0 +1,75 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// snapshot is the graph of a completed run as written to --snapshotFile.  The next
+// run with --incremental only sends what changed since then to the sinks.
+type snapshot struct {
+	Organization string     `json:"organization"`
+	Customer     string     `json:"customer"`
+	Component    string     `json:"component"`
+	Saved        time.Time  `json:"saved"`
+	Graph        *jsonGraph `json:"graph"`
+}
+
+func saveSnapshot(path string, g *graph) error {
+	jg, err := g.toJSON()
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(&snapshot{
+		Organization: *organization,
+		Customer:     *cx,
+		Component:    *component,
+		Saved:        time.Now(),
+		Graph:        jg,
+	})
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(path, data); err != nil {
+		return err
+	}
+	glog.V(2).Infof(">>>>>>>>>>> Saved snapshot of %d vertices and %d edges to %s", len(jg.Vertices), len(jg.Edges), path)
+	return nil
+}
+
+// loadSnapshot reads a snapshot and the graph in it.
+func loadSnapshot(path string) (*snapshot, *graph, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	sn := &snapshot{}
+	if err := json.Unmarshal(data, sn); err != nil {
+		return nil, nil, fmt.Errorf("%s: %v", path, err)
+	}
+	g := newGraph()
+	if sn.Graph != nil {
+		if err := g.load(sn.Graph); err != nil {
+			return nil, nil, fmt.Errorf("%s: %v", path, err)
+		}
+	}
+	return sn, g, nil
+}
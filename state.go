@@ -0,0 +1,210 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// crawlState is the progress of a crawl: the units of work (a project's IAM policy,
+// a group's members, the roles of a parent...) that are done and the page tokens of
+// the long listings.  It is saved with the graph to --stateFile so --resume can skip
+// what was already loaded.
+type crawlState struct {
+	mu sync.Mutex
+	// Done maps a unit (eg, IAM:projects/my-project) to its result, if any (the nested
+	// groups for a group's members)
+	Done       map[string][]string `json:"done"`
+	PageTokens map[string]string   `json:"pageTokens"`
+}
+
+// savedState is what is written to --stateFile.
+type savedState struct {
+	Organization string      `json:"organization"`
+	Customer     string      `json:"customer"`
+	Saved        time.Time   `json:"saved"`
+	State        *crawlState `json:"state"`
+	Graph        *jsonGraph  `json:"graph"`
+}
+
+var state = newCrawlState()
+
+func newCrawlState() *crawlState {
+	return &crawlState{
+		Done:       make(map[string][]string),
+		PageTokens: make(map[string]string),
+	}
+}
+
+func (s *crawlState) isDone(unit string) ([]string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	result, ok := s.Done[unit]
+	return result, ok
+}
+
+// markDone records that everything for unit is in the graph.
+func (s *crawlState) markDone(unit string, result ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if result == nil {
+		result = []string{}
+	}
+	s.Done[unit] = result
+	delete(s.PageTokens, unit)
+}
+
+// pageToken is where to continue listing unit ("" to start from the beginning).
+func (s *crawlState) pageToken(unit string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.PageTokens[unit]
+}
+
+// setPageToken records the next page of unit once the current one is in the graph.
+func (s *crawlState) setPageToken(unit, token string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.PageTokens[unit] = token
+}
+
+// saveState writes the state and the graph to path, replacing the previous file only
+// once the new one is complete.
+func saveState(path string, g *graph) error {
+	// copy the state before the graph: every unit marked done is then in the graph
+	state.mu.Lock()
+	cs := newCrawlState()
+	for k, v := range state.Done {
+		cs.Done[k] = v
+	}
+	for k, v := range state.PageTokens {
+		cs.PageTokens[k] = v
+	}
+	state.mu.Unlock()
+
+	jg, err := g.toJSON()
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(&savedState{
+		Organization: *organization,
+		Customer:     *cx,
+		Saved:        time.Now(),
+		State:        cs,
+		Graph:        jg,
+	})
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(path, data); err != nil {
+		return err
+	}
+	glog.V(2).Infof(">>>>>>>>>>> Saved %d done units and %d vertices to %s", len(cs.Done), len(jg.Vertices), path)
+	return nil
+}
+
+// writeFileAtomic replaces path with data only once all of it is written, so a crash
+// never leaves a truncated file behind.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// loadState restores the state and the graph of a previous run of the same
+// organization and customer.  A missing file is not an error: there is nothing to resume.
+func loadState(path string, g *graph) error {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		glog.Warningf("No state in %s, starting from the beginning", path)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	sf := &savedState{}
+	if err := json.Unmarshal(data, sf); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	if sf.Organization != *organization || sf.Customer != *cx {
+		return fmt.Errorf("%s is for organization %s customer %s", path, sf.Organization, sf.Customer)
+	}
+	if sf.Graph != nil {
+		if err := g.load(sf.Graph); err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+	}
+	if sf.State != nil {
+		state.mu.Lock()
+		for k, v := range sf.State.Done {
+			state.Done[k] = v
+		}
+		for k, v := range sf.State.PageTokens {
+			state.PageTokens[k] = v
+		}
+		state.mu.Unlock()
+	}
+	vc, _ := g.counts()
+	glog.V(2).Infof(">>>>>>>>>>> Resuming from %s saved %v: %d done units, %v vertices", path, sf.Saved, len(state.Done), vc)
+	return nil
+}
+
+// checkpoint saves the state to path every interval until stop is closed.  It is also
+// saved (before exiting) when the process is interrupted.
+func checkpoint(path string, interval time.Duration, g *graph, stop <-chan struct{}) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sig)
+	for {
+		select {
+		case <-stop:
+			return
+		case s := <-sig:
+			glog.Warningf("%v: saving state to %s", s, path)
+			if err := saveState(path, g); err != nil {
+				glog.Errorf("Unable to save state to %s: %v", path, err)
+			}
+			glog.Flush()
+			os.Exit(1)
+		case <-t.C:
+			if err := saveState(path, g); err != nil {
+				glog.Errorf("Unable to save state to %s: %v", path, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,182 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+	"golang.org/x/time/rate"
+)
+
+// retryPolicy is how an API is throttled and how failed calls to it are retried.
+type retryPolicy struct {
+	qps        float64 // requests per second, 0 for no limit
+	burst      int
+	maxRetries int
+	minBackoff time.Duration
+	maxBackoff time.Duration
+}
+
+// retryTransport rate limits the requests to one API and retries the ones that fail
+// with a retryable status (429, 5xx or a 403 rate limit error) with jittered
+// exponential backoff, waiting at least as long as the server's Retry-After.
+type retryTransport struct {
+	api     string
+	base    http.RoundTripper
+	policy  retryPolicy
+	limiter *rate.Limiter
+	// sleep is replaceable so the backoff can be tested without waiting
+	sleep func(ctx context.Context, d time.Duration) error
+}
+
+func newRetryTransport(api string, base http.RoundTripper, policy retryPolicy) *retryTransport {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	limit := rate.Inf
+	if policy.qps > 0 {
+		limit = rate.Limit(policy.qps)
+	}
+	if policy.burst < 1 {
+		policy.burst = 1
+	}
+	return &retryTransport{
+		api:     api,
+		base:    base,
+		policy:  policy,
+		limiter: rate.NewLimiter(limit, policy.burst),
+		sleep:   sleepContext,
+	}
+}
+
+// apiContext returns a context that makes the oauth2 clients created from it (eg,
+// google.JWTConfig.Client) send their requests through t.
+func apiContext(ctx context.Context, t *retryTransport) context.Context {
+	return context.WithValue(ctx, oauth2.HTTPClient, &http.Client{Transport: t})
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	for attempt := 0; ; attempt++ {
+		if err := t.limiter.Wait(ctx); err != nil {
+			return nil, err
+		}
+		r := req
+		if attempt > 0 && req.Body != nil {
+			// the body was consumed by the previous attempt
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			r = req.Clone(ctx)
+			r.Body = body
+		}
+		resp, err := t.base.RoundTrip(r)
+
+		if attempt >= t.policy.maxRetries || !t.retryable(req, resp, err) {
+			return resp, err
+		}
+		wait := t.backoff(attempt)
+		if resp != nil {
+			if ra := retryAfter(resp.Header.Get("Retry-After")); ra > wait {
+				wait = ra
+			}
+			glog.V(2).Infof("%s %s %s: %s, retrying in %v", t.api, req.Method, req.URL.Path, resp.Status, wait)
+			ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+		} else {
+			glog.V(2).Infof("%s %s %s: %v, retrying in %v", t.api, req.Method, req.URL.Path, err, wait)
+		}
+		if err := t.sleep(ctx, wait); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (t *retryTransport) retryable(req *http.Request, resp *http.Response, err error) bool {
+	if req.Body != nil && req.GetBody == nil {
+		return false
+	}
+	if err != nil {
+		return req.Context().Err() == nil
+	}
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	case http.StatusForbidden:
+		// the Admin SDK reports quota errors as 403 with a rateLimitExceeded reason
+		return rateLimited(resp)
+	}
+	return false
+}
+
+// rateLimited reads the error body (and puts it back for the caller) to check for
+// a rateLimitExceeded or userRateLimitExceeded reason.
+func rateLimited(resp *http.Response) bool {
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return false
+	}
+	return bytes.Contains(body, []byte(`"rateLimitExceeded"`)) || bytes.Contains(body, []byte(`"userRateLimitExceeded"`))
+}
+
+// backoff is the wait before retry attempt+1: a random duration between half and all
+// of minBackoff*2^attempt, capped at maxBackoff.
+func (t *retryTransport) backoff(attempt int) time.Duration {
+	d := t.policy.minBackoff << uint(attempt)
+	if d > t.policy.maxBackoff || d <= 0 {
+		d = t.policy.maxBackoff
+	}
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// retryAfter parses a Retry-After header, either in seconds or an HTTP date.
+func retryAfter(v string) time.Duration {
+	if v == "" {
+		return 0
+	}
+	if s, err := strconv.Atoi(v); err == nil {
+		return time.Duration(s) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return time.Until(t)
+	}
+	return 0
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
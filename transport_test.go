@@ -0,0 +1,195 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// flakyServer fails the first len(failures) requests with the given responses and
+// answers 200 after that, recording the body of every request.
+type flakyServer struct {
+	*httptest.Server
+
+	mu     sync.Mutex
+	bodies []string
+}
+
+type failure struct {
+	code       int
+	body       string
+	retryAfter string
+}
+
+func newFlakyServer(failures ...failure) *flakyServer {
+	s := &flakyServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		s.mu.Lock()
+		n := len(s.bodies)
+		s.bodies = append(s.bodies, string(body))
+		s.mu.Unlock()
+		if n < len(failures) {
+			f := failures[n]
+			if f.retryAfter != "" {
+				w.Header().Set("Retry-After", f.retryAfter)
+			}
+			w.WriteHeader(f.code)
+			w.Write([]byte(f.body))
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	return s
+}
+
+func (s *flakyServer) calls() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.bodies)
+}
+
+// testTransport retries up to 3 times and records its waits instead of sleeping.
+func testTransport() (*retryTransport, *[]time.Duration) {
+	t := newRetryTransport("test", nil, retryPolicy{maxRetries: 3, minBackoff: 10 * time.Millisecond, maxBackoff: 40 * time.Millisecond})
+	var waits []time.Duration
+	t.sleep = func(ctx context.Context, d time.Duration) error {
+		waits = append(waits, d)
+		return nil
+	}
+	return t, &waits
+}
+
+func TestRetryStatus(t *testing.T) {
+	for _, code := range []int{http.StatusTooManyRequests, http.StatusServiceUnavailable, http.StatusInternalServerError} {
+		s := newFlakyServer(failure{code: code}, failure{code: code})
+		rt, waits := testTransport()
+		resp, err := (&http.Client{Transport: rt}).Get(s.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusOK || s.calls() != 3 {
+			t.Errorf("%d: got %s after %d calls, want 200 after 3", code, resp.Status, s.calls())
+		}
+		if len(*waits) != 2 {
+			t.Fatalf("%d: waited %d times, want 2", code, len(*waits))
+		}
+		for i, w := range *waits {
+			max := 10 * time.Millisecond << uint(i)
+			if w < max/2 || w > max {
+				t.Errorf("%d: wait %d is %v, want between %v and %v", code, i, w, max/2, max)
+			}
+		}
+		s.Close()
+	}
+}
+
+func TestNoRetry(t *testing.T) {
+	for _, f := range []failure{
+		{code: http.StatusNotFound},
+		{code: http.StatusBadRequest},
+		{code: http.StatusForbidden, body: `{"error":{"errors":[{"reason":"forbidden"}],"code":403}}`},
+	} {
+		s := newFlakyServer(f)
+		rt, _ := testTransport()
+		resp, err := (&http.Client{Transport: rt}).Get(s.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		if resp.StatusCode != f.code || s.calls() != 1 || string(body) != f.body {
+			t.Errorf("got %s %q after %d calls, want %d %q after 1", resp.Status, body, s.calls(), f.code, f.body)
+		}
+		s.Close()
+	}
+}
+
+func TestRetryRateLimitExceeded(t *testing.T) {
+	for _, reason := range []string{"rateLimitExceeded", "userRateLimitExceeded"} {
+		s := newFlakyServer(failure{code: http.StatusForbidden, body: `{"error":{"errors":[{"reason":"` + reason + `"}],"code":403}}`})
+		rt, _ := testTransport()
+		resp, err := (&http.Client{Transport: rt}).Get(s.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusOK || s.calls() != 2 {
+			t.Errorf("%s: got %s after %d calls, want 200 after 2", reason, resp.Status, s.calls())
+		}
+		s.Close()
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	s := newFlakyServer(failure{code: http.StatusTooManyRequests, retryAfter: "7"},
+		failure{code: http.StatusServiceUnavailable, retryAfter: time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)})
+	defer s.Close()
+	rt, waits := testTransport()
+	resp, err := (&http.Client{Transport: rt}).Get(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("got %s, want 200", resp.Status)
+	}
+	if len(*waits) != 2 || (*waits)[0] != 7*time.Second || (*waits)[1] < 59*time.Minute {
+		t.Errorf("waited %v, want 7s then about an hour", *waits)
+	}
+}
+
+func TestRetryPostBody(t *testing.T) {
+	s := newFlakyServer(failure{code: http.StatusServiceUnavailable}, failure{code: http.StatusTooManyRequests})
+	defer s.Close()
+	rt, _ := testTransport()
+	const body = `{"options":{"requestedPolicyVersion":3}}`
+	resp, err := (&http.Client{Transport: rt}).Post(s.URL, "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("got %s, want 200", resp.Status)
+	}
+	if len(s.bodies) != 3 {
+		t.Fatalf("%d calls, want 3", len(s.bodies))
+	}
+	for i, b := range s.bodies {
+		if b != body {
+			t.Errorf("attempt %d sent %q, want %q", i, b, body)
+		}
+	}
+}
+
+func TestMaxRetries(t *testing.T) {
+	s := newFlakyServer(failure{code: 503}, failure{code: 503}, failure{code: 503}, failure{code: 503}, failure{code: 503})
+	defer s.Close()
+	rt, waits := testTransport()
+	resp, err := (&http.Client{Transport: rt}).Get(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusServiceUnavailable || s.calls() != 4 || len(*waits) != 3 {
+		t.Errorf("got %s after %d calls and %d waits, want 503 after 4 calls and 3 waits", resp.Status, s.calls(), len(*waits))
+	}
+	if (*waits)[2] > 40*time.Millisecond {
+		t.Errorf("waited %v, want at most --maxBackoff", (*waits)[2])
+	}
+}